@@ -0,0 +1,273 @@
+package jx
+
+import (
+	"archive/tar"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"github.com/Unknwon/com"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// name of manifest entry in backup archive.
+const backupManifest = "MANIFEST.json"
+
+// BackupManifest lists all files in backup archive.
+// it's the last entry of archive.
+type BackupManifest struct {
+	Created time.Time     `json:"created"`
+	Files   []*BackupFile `json:"files"`
+}
+
+// BackupFile is file in backup archive with size and sha256 checksum.
+type BackupFile struct {
+	Name   string `json:"name"`
+	Size   int64  `json:"size"`
+	Sha256 string `json:"sha256"`
+}
+
+// backup all synced tables to writer as tar archive.
+// files sizes are snapshot under read locks of all tables, so writing waits only for snapshot.
+// then files are copied to snapshot sizes, as chunk and pk files are only appended.
+func (s *Storage) Backup(w io.Writer) (e error) {
+	return s.BackupContext(context.Background(), w)
+}
+
+// backup all synced tables to writer until ctx is canceled.
+// ctx is checked between files and when copying file, canceled archive is not complete.
+func (s *Storage) BackupContext(ctx context.Context, w io.Writer) (e error) {
+	names := make([]string, 0, len(s.tables))
+	tables := s.Tables()
+	for name := range tables {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	// snapshot file sizes at same time
+	files := make(map[string]int64)
+	for _, name := range names {
+		tables[name].lock.RLock()
+	}
+	for _, name := range names {
+		if e = tables[name].files(files); e != nil {
+			break
+		}
+	}
+	for _, name := range names {
+		tables[name].lock.RUnlock()
+	}
+	if e != nil {
+		return
+	}
+
+	list := make([]string, 0, len(files))
+	for file := range files {
+		list = append(list, file)
+	}
+	sort.Strings(list)
+
+	now := time.Now()
+	manifest := &BackupManifest{Created: now}
+	tw := tar.NewWriter(w)
+	for _, file := range list {
+		if e = ctx.Err(); e != nil {
+			return
+		}
+		var bf *BackupFile
+		if bf, e = s.backupFile(ctx, tw, file, files[file], now); e != nil {
+			return
+		}
+		manifest.Files = append(manifest.Files, bf)
+	}
+
+	b, e := json.MarshalIndent(manifest, "", "  ")
+	if e != nil {
+		return
+	}
+	hdr := &tar.Header{Name: backupManifest, Mode: 0644, Size: int64(len(b)), ModTime: now}
+	if e = tw.WriteHeader(hdr); e != nil {
+		return
+	}
+	if _, e = tw.Write(b); e != nil {
+		return
+	}
+	e = tw.Close()
+	return
+}
+
+// write file to tar archive in size.
+func (s *Storage) backupFile(ctx context.Context, tw *tar.Writer, file string, size int64, now time.Time) (bf *BackupFile, e error) {
+	name, e := filepath.Rel(s.directory, file)
+	if e != nil {
+		return
+	}
+	f, e := os.Open(file)
+	if e != nil {
+		return
+	}
+	defer f.Close()
+
+	bf = &BackupFile{Name: filepath.ToSlash(name), Size: size}
+	hdr := &tar.Header{Name: bf.Name, Mode: 0644, Size: size, ModTime: now}
+	if e = tw.WriteHeader(hdr); e != nil {
+		return
+	}
+	h := sha256.New()
+	if _, e = io.CopyN(io.MultiWriter(tw, h), &contextReader{ctx: ctx, r: f}, size); e != nil {
+		return
+	}
+	bf.Sha256 = hex.EncodeToString(h.Sum(nil))
+	return
+}
+
+// collect data files of table with sizes.
+func (t *Table) files(files map[string]int64) (e error) {
+	chunkFiles, e := t.Chunk.Files()
+	if e != nil {
+		return
+	}
+	pkFiles, e := t.Pk.Files()
+	if e != nil {
+		return
+	}
+	for file, size := range chunkFiles {
+		files[file] = size
+	}
+	for file, size := range pkFiles {
+		files[file] = size
+	}
+	file := path.Join(t.directory, schemaFile)
+	if fi, _ := os.Stat(file); fi != nil {
+		files[file] = fi.Size()
+	}
+	return
+}
+
+// verify backup archive.
+// it checks all files are same as manifest in size and sha256 checksum.
+func VerifyBackup(r io.Reader) (manifest *BackupManifest, e error) {
+	return readBackup(r, nil)
+}
+
+// restore backup archive to directory.
+// the directory must be empty or not existed.
+// files are verified in a temporary directory before renaming to directory,
+// so nothing is restored if the archive is broken.
+func Restore(r io.Reader, dir string) (e error) {
+	if com.IsDir(dir) {
+		entries, e := ioutil.ReadDir(dir)
+		if e != nil {
+			return e
+		}
+		if len(entries) > 0 {
+			return fmt.Errorf("restore directory is not empty : %s", dir)
+		}
+	}
+	tmpDir := strings.TrimSuffix(dir, string(filepath.Separator)) + ".restore"
+	if e = os.RemoveAll(tmpDir); e != nil {
+		return
+	}
+	_, e = readBackup(r, func(name string, src io.Reader) error {
+		return restoreFile(filepath.Join(tmpDir, filepath.FromSlash(name)), src)
+	})
+	if e != nil {
+		os.RemoveAll(tmpDir)
+		return
+	}
+	if com.IsDir(dir) {
+		if e = os.Remove(dir); e != nil {
+			return
+		}
+	}
+	e = os.Rename(tmpDir, dir)
+	return
+}
+
+// write restored file.
+func restoreFile(file string, src io.Reader) (e error) {
+	if e = os.MkdirAll(filepath.Dir(file), os.ModePerm); e != nil {
+		return
+	}
+	f, e := os.OpenFile(file, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, os.ModePerm)
+	if e != nil {
+		return
+	}
+	if _, e = io.Copy(f, src); e != nil {
+		f.Close()
+		return
+	}
+	if e = f.Sync(); e != nil {
+		f.Close()
+		return
+	}
+	e = f.Close()
+	return
+}
+
+// read backup archive, fn gets each file except manifest.
+// it checks files with manifest after reading all.
+func readBackup(r io.Reader, fn func(name string, src io.Reader) error) (manifest *BackupManifest, e error) {
+	tr := tar.NewReader(r)
+	files := make(map[string]*BackupFile)
+	for {
+		hdr, e := tr.Next()
+		if e == io.EOF {
+			break
+		}
+		if e != nil {
+			return nil, e
+		}
+		if manifest != nil {
+			return nil, fmt.Errorf("backup file after manifest : %s", hdr.Name)
+		}
+		if hdr.Name == backupManifest {
+			manifest = new(BackupManifest)
+			if e = json.NewDecoder(tr).Decode(manifest); e != nil {
+				return nil, e
+			}
+			continue
+		}
+
+		name := path.Clean(hdr.Name)
+		if path.IsAbs(name) || name == ".." || strings.HasPrefix(name, "../") {
+			return nil, fmt.Errorf("backup file is out of directory : %s", hdr.Name)
+		}
+		h := sha256.New()
+		src := io.TeeReader(tr, h)
+		if fn != nil {
+			if e = fn(name, src); e != nil {
+				return nil, e
+			}
+		}
+		if _, e = io.Copy(ioutil.Discard, src); e != nil {
+			return nil, e
+		}
+		files[name] = &BackupFile{Name: name, Size: hdr.Size, Sha256: hex.EncodeToString(h.Sum(nil))}
+	}
+
+	if manifest == nil {
+		return nil, fmt.Errorf("backup manifest is missing")
+	}
+	if len(files) != len(manifest.Files) {
+		return nil, fmt.Errorf("backup files are %d, but manifest lists %d", len(files), len(manifest.Files))
+	}
+	for _, bf := range manifest.Files {
+		f := files[bf.Name]
+		if f == nil {
+			return nil, fmt.Errorf("backup file is missing : %s", bf.Name)
+		}
+		if f.Size != bf.Size || f.Sha256 != bf.Sha256 {
+			return nil, fmt.Errorf("backup file is broken : %s", bf.Name)
+		}
+	}
+	return
+}
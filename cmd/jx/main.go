@@ -0,0 +1,370 @@
+// Command jx reads and maintains jx storage directory without Go types.
+//
+// Usage:
+//
+//	jx [-dir directory] [-pk kinds] <command> [arguments]
+//
+// Pk kinds, such as string,int, read legacy pk file of table without schema.json.
+//
+// Commands:
+//
+//	tables                 list tables with pk fields and value count
+//	stats [table]          show values, pk log, chunk files and dead bytes
+//	dump <table>           print pk and value of each live value
+//	get <table> <pk>...    print value by pk, composite pk needs all fields
+//	export <table>         write live values as json lines to stdout
+//	import <table> [file]  read json lines from file or stdin
+//	verify [table]         check pk and chunk files
+//	compact [table]        clean deleted and old values in files
+//	rebuild [table]        rebuild pk files from chunk files
+//
+// Commands except import, compact and rebuild only read files.
+// Do not run import, compact or rebuild on storage directory opened by running program.
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"github.com/fuxiaohei/jx"
+	"github.com/fuxiaohei/jx/col"
+	"io"
+	"os"
+	"path"
+	"strings"
+)
+
+func main() {
+	dir := flag.String("dir", ".", "storage directory")
+	flag.StringVar(&pkKinds, "pk", "", "pk field kinds of table without schema.json, such as string,int")
+	flag.Usage = usage
+	flag.Parse()
+	if flag.NArg() < 1 {
+		usage()
+		os.Exit(2)
+	}
+	if e := run(*dir, flag.Args(), os.Stdin, os.Stdout); e != nil {
+		fmt.Fprintln(os.Stderr, "jx:", e.Error())
+		os.Exit(1)
+	}
+}
+
+// print usage.
+func usage() {
+	fmt.Fprintln(os.Stderr, `usage: jx [-dir directory] [-pk kinds] <command> [arguments]
+
+commands:
+  tables                 list tables with pk fields and value count
+  stats [table]          show values, pk log, chunk files and dead bytes
+  dump <table>           print pk and value of each live value
+  get <table> <pk>...    print value by pk, composite pk needs all fields
+  export <table>         write live values as json lines to stdout
+  import <table> [file]  read json lines from file or stdin
+                         -conflict fail|skip|overwrite, default fail
+  verify [table]         check pk and chunk files
+  compact [table]        clean deleted and old values in files
+  rebuild [table]        rebuild pk files from chunk files`)
+}
+
+// run command in storage directory.
+func run(dir string, args []string, stdin io.Reader, stdout io.Writer) error {
+	cmd, args := args[0], args[1:]
+	switch cmd {
+	case "tables":
+		return cmdTables(dir, stdout)
+	case "stats":
+		return eachTable(dir, args, true, func(t *table) error {
+			return cmdStats(t, stdout)
+		})
+	case "dump", "export", "get":
+		if len(args) < 1 {
+			return fmt.Errorf("%s need table name", cmd)
+		}
+		t, e := openTable(dir, args[0], true)
+		if e != nil {
+			return e
+		}
+		defer t.Close()
+		switch cmd {
+		case "dump":
+			return cmdDump(t, stdout)
+		case "export":
+			return cmdExport(t, stdout)
+		}
+		return cmdGet(t, args[1:], stdout)
+	case "import":
+		return cmdImport(dir, args, stdin, stdout)
+	case "verify":
+		return eachTable(dir, args, true, func(t *table) error {
+			return cmdVerify(t, stdout)
+		})
+	case "compact":
+		return eachTable(dir, args, false, func(t *table) error {
+			return cmdCompact(dir, t, stdout)
+		})
+	case "rebuild":
+		return cmdRebuild(dir, args, stdout)
+	}
+	return fmt.Errorf("unknown command : %s", cmd)
+}
+
+// open named table or all tables, and call fn for each.
+func eachTable(dir string, args []string, readOnly bool, fn func(t *table) error) (e error) {
+	names := args
+	if len(names) < 1 {
+		if names, e = listTables(dir); e != nil {
+			return
+		}
+	}
+	for _, name := range names {
+		t, e := openTable(dir, name, readOnly)
+		if e != nil {
+			return e
+		}
+		e = fn(t)
+		if ce := t.Close(); e == nil {
+			e = ce
+		}
+		if e != nil {
+			return e
+		}
+	}
+	return
+}
+
+// list tables.
+func cmdTables(dir string, w io.Writer) error {
+	names, e := listTables(dir)
+	if e != nil {
+		return e
+	}
+	for _, name := range names {
+		t, e := openTable(dir, name, true)
+		if e != nil {
+			return e
+		}
+		pks := "?"
+		if t.schema != nil {
+			fields := make([]string, len(t.schema.Pks))
+			for i, f := range t.schema.Pks {
+				fields[i] = f.Name
+			}
+			pks = strings.Join(fields, ",")
+		}
+		count := 0
+		e = t.each(func(_ *col.PkValue, _ json.RawMessage) error {
+			count++
+			return nil
+		})
+		t.Close()
+		if e != nil {
+			return e
+		}
+		fmt.Fprintf(w, "%s\tpk:%s\tvalues:%d\n", name, pks, count)
+	}
+	return nil
+}
+
+// show table stats.
+func cmdStats(t *table, w io.Writer) error {
+	stats, e := jx.StatTable(t.name, t.pk, t.chunk)
+	if e != nil {
+		return e
+	}
+	fmt.Fprintf(w, "%s\n  values: %d\n  pk keys: %d\n  pk log: %d\n  chunk files: %d\n  chunk bytes: %d\n  dead bytes: %d\n  auto increment: %d\n",
+		t.name, stats.Records, stats.PkKeys, stats.PkLog, stats.Chunks, stats.Bytes, stats.DeadBytes, stats.AutoIncrement)
+	for _, cs := range stats.ChunkFiles {
+		fmt.Fprintf(w, "  %s\tbytes:%d\tframes:%d\tdead:%d\n", path.Base(cs.File), cs.Bytes, cs.Frames, cs.DeadBytes)
+	}
+	return nil
+}
+
+// print pk and value of live values.
+func cmdDump(t *table, w io.Writer) error {
+	return t.each(func(pkValue *col.PkValue, raw json.RawMessage) error {
+		_, e := fmt.Fprintf(w, "%s\t%s\n", formatKey(pkValue.Key), raw)
+		return e
+	})
+}
+
+// write live values as json lines.
+func cmdExport(t *table, w io.Writer) error {
+	bw := bufio.NewWriter(w)
+	e := t.each(func(_ *col.PkValue, raw json.RawMessage) error {
+		bw.Write(raw)
+		return bw.WriteByte('\n')
+	})
+	if e != nil {
+		return e
+	}
+	return bw.Flush()
+}
+
+// print value by pk.
+func cmdGet(t *table, args []string, w io.Writer) error {
+	raw, e := t.get(args)
+	if e != nil {
+		return e
+	}
+	b, e := json.MarshalIndent(raw, "", "  ")
+	if e != nil {
+		return e
+	}
+	_, e = fmt.Fprintf(w, "%s\n", b)
+	return e
+}
+
+// import json lines to table.
+func cmdImport(dir string, args []string, stdin io.Reader, w io.Writer) error {
+	flags := flag.NewFlagSet("import", flag.ContinueOnError)
+	conflict := flags.String("conflict", "fail", "conflict policy, fail, skip or overwrite")
+	if e := flags.Parse(args); e != nil {
+		return e
+	}
+	args = flags.Args()
+	if len(args) < 1 {
+		return fmt.Errorf("import need table name")
+	}
+	policies := map[string]jx.ConflictPolicy{
+		"fail":      jx.ConflictFail,
+		"skip":      jx.ConflictSkip,
+		"overwrite": jx.ConflictOverwrite,
+	}
+	policy, ok := policies[*conflict]
+	if !ok {
+		return fmt.Errorf("unknown conflict policy : %s", *conflict)
+	}
+	r := stdin
+	if len(args) > 1 {
+		f, e := os.Open(args[1])
+		if e != nil {
+			return e
+		}
+		defer f.Close()
+		r = f
+	}
+
+	t, e := openTable(dir, args[0], false)
+	if e != nil {
+		return e
+	}
+	defer t.Close()
+	if e = t.needSchema(); e != nil {
+		return e
+	}
+	dec := json.NewDecoder(r)
+	n := 0
+	for i := 1; ; i++ {
+		var raw json.RawMessage
+		if e = dec.Decode(&raw); e != nil {
+			if e == io.EOF {
+				break
+			}
+			return fmt.Errorf("import value %d : %s", i, e.Error())
+		}
+		ok, e := t.importValue(raw, policy)
+		if e != nil {
+			return fmt.Errorf("import value %d : %s", i, e.Error())
+		}
+		if ok {
+			n++
+		}
+	}
+	_, e = fmt.Fprintf(w, "imported %d values\n", n)
+	return e
+}
+
+// verify pk and chunk files, print problems and orphan frames count.
+func cmdVerify(t *table, w io.Writer) error {
+	r, e := jx.VerifyTable(t.name, t.pk, t.chunk, t.auto, t.keyOf)
+	if e != nil {
+		return e
+	}
+	for _, p := range r.Problems {
+		fmt.Fprintf(w, "%s\t%s", t.name, p.Kind)
+		if p.Pk != nil {
+			fmt.Fprintf(w, "\tpk:%v", p.Pk)
+		}
+		if p.File != "" {
+			fmt.Fprintf(w, "\t%s:%d", p.File, p.Offset)
+		}
+		fmt.Fprintf(w, "\t%s\n", p.Message)
+	}
+	if !r.OK() {
+		return fmt.Errorf("%s : %d problems", t.name, len(r.Problems))
+	}
+	_, e = fmt.Fprintf(w, "%s\tok\tvalues:%d\tframes:%d\torphans:%d\n", t.name, r.Values, r.Frames, len(r.Orphans))
+	return e
+}
+
+// clean deleted and old values.
+// optimized files replace data files when table is opened again.
+func cmdCompact(dir string, t *table, w io.Writer) error {
+	if e := t.chunk.ReadAll(); e != nil {
+		return e
+	}
+	t.chunk.Retain(t.pk.Prefix(nil))
+	if e := t.pk.Optimize(); e != nil {
+		return e
+	}
+	if e := t.chunk.Optimize(); e != nil {
+		return e
+	}
+	if e := t.Close(); e != nil {
+		return e
+	}
+	// open again to replace data files by optimized files
+	t2, e := openTable(dir, t.name, false)
+	if e != nil {
+		return e
+	}
+	*t = *t2
+	_, e = fmt.Fprintf(w, "%s\tcompacted\n", t.name)
+	return e
+}
+
+// rebuild pk files of tables from chunk files.
+// pk files are reset before opening table, so broken pk file can be rebuilt,
+// old pk file is restored if rebuilding fails.
+func cmdRebuild(dir string, args []string, w io.Writer) (e error) {
+	names := args
+	if len(names) < 1 {
+		if names, e = listTables(dir); e != nil {
+			return
+		}
+	}
+	for _, name := range names {
+		schema, e := jx.ReadSchema(path.Join(dir, name))
+		if e != nil {
+			return fmt.Errorf("schema is missing, sync the table by new version first : %s", name)
+		}
+		restore, e := col.ResetPkFiles(path.Join(dir, name, "_pk"), schema.PkAuto)
+		if e != nil {
+			return e
+		}
+		r, e := rebuildTable(dir, name)
+		if e != nil {
+			restore()
+			return e
+		}
+		for _, p := range r.Skipped {
+			fmt.Fprintf(w, "%s\tskipped\t%s\t%s:%d\t%s\n", name, p.Kind, p.File, p.Offset, p.Message)
+		}
+		fmt.Fprintf(w, "%s\trebuilt\tvalues:%d\tframes:%d\tdeleted:%d\n", name, r.Values, r.Frames, r.Deleted)
+	}
+	return
+}
+
+// open table with reset pk files and rebuild them.
+func rebuildTable(dir, name string) (r *jx.RebuildReport, e error) {
+	t, e := openTable(dir, name, false)
+	if e != nil {
+		return
+	}
+	r, e = jx.RebuildTable(t.pk, t.chunk, t.decode)
+	if ce := t.Close(); e == nil {
+		e = ce
+	}
+	return
+}
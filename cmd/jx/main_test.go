@@ -0,0 +1,238 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"github.com/fuxiaohei/jx"
+	"github.com/fuxiaohei/jx/col"
+	"io/ioutil"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+type User struct {
+	Id   int64 `jx:"pk-auto" json:"id"`
+	Name string
+}
+
+type Member struct {
+	Group string `jx:"pk"`
+	Id    int64  `jx:"pk"`
+	Role  string
+}
+
+func TestCommands(t *testing.T) {
+	dir := t.TempDir()
+	s, e := jx.NewStorage(dir)
+	if e != nil {
+		t.Fatal(e)
+	}
+	if e = s.Sync(new(User), new(Member)); e != nil {
+		t.Fatal(e)
+	}
+	for _, name := range []string{"a", "b", "c"} {
+		if e = s.Insert(&User{Name: name}); e != nil {
+			t.Fatal(e)
+		}
+	}
+	s.Update(&User{Id: 2, Name: "bb"})
+	s.Delete(&User{Id: 3})
+	s.Insert(&Member{Group: "admin", Id: 1, Role: "owner"})
+	if e = s.Close(); e != nil {
+		t.Fatal(e)
+	}
+
+	exec := func(args ...string) string {
+		var out bytes.Buffer
+		if e := run(dir, args, strings.NewReader(""), &out); e != nil {
+			t.Fatalf("%v : %v", args, e)
+		}
+		return out.String()
+	}
+
+	if out := exec("tables"); out != "main.Member\tpk:Group,Id\tvalues:1\nmain.User\tpk:Id\tvalues:2\n" {
+		t.Errorf("wrong tables : %q", out)
+	}
+	if out := exec("dump", "main.User"); out != "1\t{\"id\":1,\"Name\":\"a\"}\n2\t{\"id\":2,\"Name\":\"bb\"}\n" {
+		t.Errorf("wrong dump : %q", out)
+	}
+	if out := exec("get", "main.Member", "admin", "1"); !strings.Contains(out, `"Role": "owner"`) {
+		t.Errorf("wrong get : %q", out)
+	}
+	export := exec("export", "main.User")
+	exec("verify")
+	if out := exec("rebuild", "main.User"); out != "main.User\trebuilt\tvalues:2\tframes:4\tdeleted:1\n" {
+		t.Errorf("wrong rebuild : %q", out)
+	}
+	exec("compact")
+	if out := exec("stats", "main.User"); !strings.Contains(out, "values: 2") {
+		t.Errorf("wrong stats : %q", out)
+	}
+
+	var out bytes.Buffer
+	if e = run(dir, []string{"import", "main.User"}, strings.NewReader(export), &out); e == nil {
+		t.Error("expect conflict error")
+	}
+	in := export + `{"id":10,"Name":"j"}` + "\n" + `{"Name":"k"}` + "\n"
+	if e = run(dir, []string{"import", "-conflict", "skip", "main.User"}, strings.NewReader(in), &out); e != nil {
+		t.Fatal(e)
+	}
+	if out.String() != "imported 2 values\n" {
+		t.Errorf("wrong import : %q", out.String())
+	}
+
+	// storage reads imported values and continues auto increment
+	s, e = jx.NewStorage(dir)
+	if e != nil {
+		t.Fatal(e)
+	}
+	defer s.Close()
+	if e = s.Sync(new(User), new(Member)); e != nil {
+		t.Fatal(e)
+	}
+	u := &User{Id: 11}
+	if e = s.Get(u); e != nil || u.Name != "k" {
+		t.Errorf("expect imported value, but got %v, %v", u, e)
+	}
+	u = &User{Name: "l"}
+	if e = s.Insert(u); e != nil {
+		t.Fatal(e)
+	}
+	if u.Id != 12 {
+		t.Errorf("expect id %d, but got %d", 12, u.Id)
+	}
+}
+
+func TestLegacyPk(t *testing.T) {
+	dir := t.TempDir()
+	s, e := jx.NewStorage(dir)
+	if e != nil {
+		t.Fatal(e)
+	}
+	if e = s.Sync(new(Member)); e != nil {
+		t.Fatal(e)
+	}
+	if e = s.Insert(&Member{Group: "admin", Id: 1, Role: "owner"}); e != nil {
+		t.Fatal(e)
+	}
+	pkValue, e := s.Table(new(Member)).Pk.Get([]interface{}{"admin", int64(1)})
+	if e != nil || pkValue == nil {
+		t.Fatalf("expect pk value, but got %v", e)
+	}
+	if e = s.Close(); e != nil {
+		t.Fatal(e)
+	}
+
+	// rewrite pk file with legacy string key
+	b, _ := json.Marshal(&col.PkValue{Value: "admin\x00\x01" + "1\x00\x01", Uid: pkValue.Uid, Cursor: pkValue.Cursor})
+	head := make([]byte, 8)
+	binary.BigEndian.PutUint64(head, uint64(len(b)))
+	pkDir := path.Join(dir, "main.Member", "_pk")
+	os.Remove(path.Join(pkDir, "pk.pk.opm"))
+	if e = ioutil.WriteFile(path.Join(pkDir, "pk.pk"), append(head, b...), os.ModePerm); e != nil {
+		t.Fatal(e)
+	}
+
+	var out bytes.Buffer
+	if e = run(dir, []string{"get", "main.Member", "admin", "1"}, strings.NewReader(""), &out); e != nil || !strings.Contains(out.String(), `"Role": "owner"`) {
+		t.Errorf("wrong get of legacy pk : %q, %v", out.String(), e)
+	}
+	// reading command does not migrate legacy pk file
+	if pk, _ := ioutil.ReadFile(path.Join(pkDir, "pk.pk")); !bytes.Equal(pk, append(head, b...)) {
+		t.Errorf("legacy pk file is changed : %q", pk)
+	}
+
+	// table without schema needs pk kinds to read legacy pk file
+	os.Remove(path.Join(dir, "main.Member", "schema.json"))
+	out.Reset()
+	if e = run(dir, []string{"dump", "main.Member"}, strings.NewReader(""), &out); e == nil || !strings.Contains(e.Error(), "-pk") {
+		t.Errorf("expect error of pk kinds, but got %v", e)
+	}
+	pkKinds = "string,int"
+	defer func() { pkKinds = "" }()
+	if e = run(dir, []string{"get", "main.Member", "admin", "1"}, strings.NewReader(""), &out); e != nil || !strings.Contains(out.String(), `"Role": "owner"`) {
+		t.Errorf("wrong get of legacy pk without schema : %q, %v", out.String(), e)
+	}
+}
+
+func TestLegacyAutoPk(t *testing.T) {
+	dir := t.TempDir()
+	s, e := jx.NewStorage(dir)
+	if e != nil {
+		t.Fatal(e)
+	}
+	if e = s.Sync(new(User)); e != nil {
+		t.Fatal(e)
+	}
+	for _, name := range []string{"a", "b"} {
+		if e = s.Insert(&User{Name: name}); e != nil {
+			t.Fatal(e)
+		}
+	}
+	var legacy []byte
+	for _, pkValue := range s.Table(new(User)).Pk.Prefix(nil) {
+		fields, _ := col.DecodeKey(pkValue.Key)
+		b, _ := json.Marshal(&col.PkValue{Value: strconv.FormatInt(fields[0].(int64), 10), Uid: pkValue.Uid, Cursor: pkValue.Cursor})
+		head := make([]byte, 8)
+		binary.BigEndian.PutUint64(head, uint64(len(b)))
+		legacy = append(append(legacy, head...), b...)
+	}
+	if e = s.Close(); e != nil {
+		t.Fatal(e)
+	}
+
+	// pk-auto table without schema is known by auto increment file, its legacy pk is int
+	pkDir := path.Join(dir, "main.User", "_pk")
+	os.Remove(path.Join(pkDir, "pk.pk.opm"))
+	os.Remove(path.Join(dir, "main.User", "schema.json"))
+	if e = ioutil.WriteFile(path.Join(pkDir, "pk.pk"), legacy, os.ModePerm); e != nil {
+		t.Fatal(e)
+	}
+	var out bytes.Buffer
+	if e = run(dir, []string{"dump", "main.User"}, strings.NewReader(""), &out); e != nil || out.String() != "1\t{\"id\":1,\"Name\":\"a\"}\n2\t{\"id\":2,\"Name\":\"b\"}\n" {
+		t.Errorf("wrong dump of legacy pk without schema : %q, %v", out.String(), e)
+	}
+	out.Reset()
+	if e = run(dir, []string{"stats", "main.User"}, strings.NewReader(""), &out); e != nil || !strings.Contains(out.String(), "auto increment: 2") {
+		t.Errorf("wrong stats of legacy pk without schema : %q, %v", out.String(), e)
+	}
+}
+
+func TestReadOnlyCommands(t *testing.T) {
+	dir := t.TempDir()
+	s, e := jx.NewStorage(dir)
+	if e != nil {
+		t.Fatal(e)
+	}
+	if e = s.Sync(new(User)); e != nil {
+		t.Fatal(e)
+	}
+	if e = s.Insert(&User{Name: "a"}); e != nil {
+		t.Fatal(e)
+	}
+	files, _ := s.Table(new(User)).Chunk.Files()
+	if e = s.Close(); e != nil {
+		t.Fatal(e)
+	}
+
+	// torn frame head is not truncated by reading commands
+	for file := range files {
+		f, _ := os.OpenFile(file, os.O_APPEND|os.O_WRONLY, os.ModePerm)
+		f.Write([]byte{1, 2, 3})
+		f.Close()
+		files[file] += 3
+	}
+	for _, args := range [][]string{{"tables"}, {"stats"}, {"dump", "main.User"}, {"get", "main.User", "1"}, {"verify"}} {
+		var out bytes.Buffer
+		run(dir, args, strings.NewReader(""), &out)
+		for file, size := range files {
+			if fi, _ := os.Stat(file); fi.Size() != size {
+				t.Fatalf("%v : expect file size %d, but got %d", args, size, fi.Size())
+			}
+		}
+	}
+}
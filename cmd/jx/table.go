@@ -0,0 +1,482 @@
+package main
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"github.com/Unknwon/com"
+	"github.com/fuxiaohei/jx"
+	"github.com/fuxiaohei/jx/col"
+	"io/ioutil"
+	"os"
+	"path"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// values are read as raw json, no Go type is needed.
+var rawType = reflect.TypeOf(json.RawMessage{})
+
+// pk field kinds of tables without schema, set by -pk flag, such as string,int.
+var pkKinds string
+
+// table opened without Go type.
+type table struct {
+	name   string
+	dir    string
+	schema *jx.Schema
+	auto   bool
+	// pk fields of schema, or kinds by -pk flag.
+	pks []*jx.SchemaField
+
+	pk    *col.PK
+	chunk *col.Chunk
+}
+
+// list table names in storage directory.
+func listTables(dir string) (names []string, e error) {
+	infos, e := ioutil.ReadDir(dir)
+	if e != nil {
+		return
+	}
+	for _, info := range infos {
+		if info.IsDir() && com.IsDir(path.Join(dir, info.Name(), "_pk")) {
+			names = append(names, info.Name())
+		}
+	}
+	sort.Strings(names)
+	return
+}
+
+// open table in storage directory by name.
+// schema is nil if table is not synced by version writing schema.
+// read-only table never changes files, so it can read directory opened by running program.
+func openTable(dir, name string, readOnly bool) (t *table, e error) {
+	t = &table{
+		name: name,
+		dir:  path.Join(dir, name),
+	}
+	if !com.IsDir(path.Join(t.dir, "_pk")) || !com.IsDir(path.Join(t.dir, "_data")) {
+		e = fmt.Errorf("no table : %s", name)
+		return
+	}
+	if t.schema, e = jx.ReadSchema(t.dir); e != nil {
+		if !os.IsNotExist(e) {
+			return
+		}
+		t.schema, e = nil, nil
+	}
+	// pk types are needed to read legacy pk file.
+	// without schema, auto increment file means pk-auto table, its pk is int.
+	if t.schema != nil {
+		t.auto, t.pks = t.schema.PkAuto, t.schema.Pks
+	} else {
+		t.auto = com.IsFile(path.Join(t.dir, "_pk", "auto.pk"))
+		if t.pks, e = kindFields(pkKinds, t.auto); e != nil {
+			return
+		}
+	}
+	types, e := pkTypes(t.pks)
+	if e != nil {
+		return
+	}
+	if readOnly {
+		t.pk, e = col.NewReadOnlyPk(path.Join(t.dir, "_pk"), t.auto, types)
+	} else {
+		t.pk, e = col.NewPk(path.Join(t.dir, "_pk"), t.auto, types)
+	}
+	if e != nil {
+		if t.schema == nil && len(types) == 0 {
+			e = fmt.Errorf("%s, set pk field kinds by -pk flag : %s", e.Error(), name)
+		}
+		return
+	}
+	if readOnly {
+		t.chunk, e = col.NewReadOnlyChunk(path.Join(t.dir, "_data"), "data", ".dat", 1000, rawType)
+	} else {
+		t.chunk, e = col.NewChunk(path.Join(t.dir, "_data"), "data", ".dat", 1000, rawType)
+	}
+	if e != nil {
+		t.pk.Close()
+		return
+	}
+	if e = t.chunk.ReadCurrent(t.pk.GetLastCursor()); e != nil {
+		t.Close()
+	}
+	return
+}
+
+// get pk fields by kinds flag, such as string,int.
+// empty kinds of pk-auto table is int.
+func kindFields(kinds string, auto bool) (fields []*jx.SchemaField, e error) {
+	if kinds == "" {
+		if auto {
+			fields = []*jx.SchemaField{{Name: "0", Kind: "int"}}
+		}
+		return
+	}
+	for i, kind := range strings.Split(kinds, ",") {
+		if kind == "bytes" {
+			return nil, fmt.Errorf("pk field kind %s needs schema", kind)
+		}
+		fields = append(fields, &jx.SchemaField{Name: strconv.Itoa(i), Kind: kind})
+	}
+	return
+}
+
+// get pk field types by schema kinds.
+// types of same kind are encoded as same key, so int kind is int64.
+func pkTypes(pks []*jx.SchemaField) (types []reflect.Type, e error) {
+	for _, f := range pks {
+		v, e := zeroField(f)
+		if e != nil {
+			return nil, e
+		}
+		types = append(types, reflect.TypeOf(v))
+	}
+	return
+}
+
+// close table files.
+func (t *table) Close() (e error) {
+	if e = t.chunk.Close(); e != nil {
+		return
+	}
+	e = t.pk.Close()
+	return
+}
+
+// need schema to parse pk values.
+func (t *table) needSchema() error {
+	if t.schema == nil {
+		return fmt.Errorf("schema is missing, sync the table by new version first : %s", t.name)
+	}
+	return nil
+}
+
+// walk live values in pk order.
+func (t *table) each(fn func(pkValue *col.PkValue, raw json.RawMessage) error) (e error) {
+	now := time.Now().UnixNano()
+	for _, pkValue := range t.pk.Prefix(nil) {
+		if pkValue.Expired(now) {
+			continue
+		}
+		v, e := t.chunk.Get(pkValue)
+		if e != nil {
+			return e
+		}
+		if v == nil {
+			return fmt.Errorf("value is missing : %s", formatKey(pkValue.Key))
+		}
+		if e = fn(pkValue, *v.(*json.RawMessage)); e != nil {
+			return e
+		}
+	}
+	return
+}
+
+// get live value by pk strings.
+func (t *table) get(args []string) (raw json.RawMessage, e error) {
+	if len(t.pks) == 0 {
+		e = fmt.Errorf("schema is missing, set pk field kinds by -pk flag : %s", t.name)
+		return
+	}
+	if len(args) != len(t.pks) {
+		e = fmt.Errorf("need %d pk values : %s", len(t.pks), t.name)
+		return
+	}
+	fields := make([]interface{}, len(args))
+	for i, arg := range args {
+		if fields[i], e = parseField(t.pks[i], arg); e != nil {
+			return
+		}
+	}
+	key, e := col.EncodeKeyFields(fields)
+	if e != nil {
+		return
+	}
+	pkValue := t.pk.GetKey(key)
+	if pkValue == nil || pkValue.Expired(time.Now().UnixNano()) {
+		e = fmt.Errorf("not found : %s", strings.Join(args, ","))
+		return
+	}
+	v, e := t.chunk.Get(pkValue)
+	if e != nil {
+		return
+	}
+	if v == nil {
+		e = fmt.Errorf("value is missing : %s", strings.Join(args, ","))
+		return
+	}
+	raw = *v.(*json.RawMessage)
+	return
+}
+
+// import one raw json value.
+// it returns false if value is skipped.
+func (t *table) importValue(raw json.RawMessage, policy jx.ConflictPolicy) (ok bool, e error) {
+	m := make(map[string]interface{})
+	dec := json.NewDecoder(strings.NewReader(string(raw)))
+	dec.UseNumber()
+	if e = dec.Decode(&m); e != nil {
+		return
+	}
+
+	fields, e := t.pkFields(m)
+	if e != nil {
+		return
+	}
+	if t.schema.PkAuto && reflect.ValueOf(fields[0]).IsZero() {
+		// new auto increment id
+		id := t.pk.GetAutoIncrement() + 1
+		if e = t.pk.AdvanceAuto(id); e != nil {
+			return
+		}
+		m[t.schema.Pks[0].Json] = id
+		fields[0], _ = jsonField(t.schema.Pks[0], json.Number(strconv.FormatInt(id, 10)))
+		if raw, e = json.Marshal(m); e != nil {
+			return
+		}
+	}
+	if t.schema.PkGen != "" && reflect.ValueOf(fields[0]).IsZero() {
+		e = fmt.Errorf("generated pk is empty : %s", t.name)
+		return
+	}
+	var exp int64
+	if t.schema.Expire != nil {
+		if exp, e = jsonExpire(t.schema.Expire, m[t.schema.Expire.Json]); e != nil {
+			return
+		}
+	}
+
+	key, e := col.EncodeKeyFields(fields)
+	if e != nil {
+		return
+	}
+	pkValue := t.pk.GetKey(key)
+	if pkValue != nil && !pkValue.Expired(time.Now().UnixNano()) {
+		switch policy {
+		case jx.ConflictSkip:
+			return false, nil
+		case jx.ConflictOverwrite:
+			if e = t.chunk.Update(&raw, pkValue); e != nil {
+				return
+			}
+			pkValue.Exp = exp
+			return true, t.pk.Update(fields, pkValue)
+		}
+		return false, jx.Conflict
+	}
+	if pkValue != nil {
+		// expired value is replaced
+		if e = t.chunk.Delete(pkValue); e != nil {
+			return
+		}
+	}
+	uid, cursor, e := t.chunk.Write(&raw)
+	if e != nil {
+		return
+	}
+	if e = t.pk.Write(fields, cursor, uid, exp); e != nil {
+		return
+	}
+	if t.schema.PkAuto {
+		id := reflect.ValueOf(fields[0])
+		if id.Kind() == reflect.Uint64 {
+			e = t.pk.AdvanceAuto(int64(id.Uint()))
+		} else {
+			e = t.pk.AdvanceAuto(id.Int())
+		}
+	}
+	return true, e
+}
+
+// get pk fields of json value by schema.
+func (t *table) pkFields(m map[string]interface{}) (fields []interface{}, e error) {
+	fields = make([]interface{}, len(t.schema.Pks))
+	for i, f := range t.schema.Pks {
+		if fields[i], e = jsonField(f, m[f.Json]); e != nil {
+			return
+		}
+	}
+	return
+}
+
+// get pk key bytes of raw json value for verifying.
+// without schema, it only checks json is valid.
+func (t *table) keyOf(data []byte) (key []byte, e error) {
+	m := make(map[string]interface{})
+	dec := json.NewDecoder(strings.NewReader(string(data)))
+	dec.UseNumber()
+	if e = dec.Decode(&m); e != nil || t.schema == nil {
+		return
+	}
+	fields, e := t.pkFields(m)
+	if e != nil {
+		return
+	}
+	return col.EncodeKeyFields(fields)
+}
+
+// get pk key bytes, version and expiration time of raw json value for rebuilding.
+func (t *table) decode(data []byte) (key []byte, version int64, exp int64, e error) {
+	m := make(map[string]interface{})
+	dec := json.NewDecoder(strings.NewReader(string(data)))
+	dec.UseNumber()
+	if e = dec.Decode(&m); e != nil {
+		return
+	}
+	fields, e := t.pkFields(m)
+	if e != nil {
+		return
+	}
+	if key, e = col.EncodeKeyFields(fields); e != nil {
+		return
+	}
+	if t.schema.Version != nil {
+		if n, ok := m[t.schema.Version.Json].(json.Number); ok {
+			version, _ = n.Int64()
+		}
+	}
+	if t.schema.Expire != nil {
+		exp, e = jsonExpire(t.schema.Expire, m[t.schema.Expire.Json])
+	}
+	return
+}
+
+// format key bytes as pk strings joined by comma.
+func formatKey(key []byte) string {
+	fields, e := col.DecodeKey(key)
+	if e != nil {
+		return hex.EncodeToString(key)
+	}
+	s := make([]string, len(fields))
+	for i, f := range fields {
+		switch v := f.(type) {
+		case int64:
+			s[i] = strconv.FormatInt(v, 10)
+		case uint64:
+			s[i] = strconv.FormatUint(v, 10)
+		case float64:
+			s[i] = strconv.FormatFloat(v, 'g', -1, 64)
+		case string:
+			s[i] = v
+		case time.Time:
+			s[i] = v.Format(time.RFC3339Nano)
+		case []byte:
+			s[i] = hex.EncodeToString(v)
+		}
+	}
+	return strings.Join(s, ",")
+}
+
+// parse pk field string by schema kind.
+// time is RFC3339 string, bytes are hex string, dashes are ignored.
+func parseField(f *jx.SchemaField, s string) (v interface{}, e error) {
+	switch f.Kind {
+	case "string":
+		return s, nil
+	case "int":
+		return strconv.ParseInt(s, 10, 64)
+	case "uint":
+		return strconv.ParseUint(s, 10, 64)
+	case "float":
+		return strconv.ParseFloat(s, 64)
+	case "time":
+		return time.Parse(time.RFC3339Nano, s)
+	case "bytes":
+		b, e := hex.DecodeString(strings.Replace(s, "-", "", -1))
+		if e != nil {
+			return nil, e
+		}
+		return byteArray(f, b)
+	}
+	return nil, fmt.Errorf("pk field kind %s is unknown : %s", f.Kind, f.Name)
+}
+
+// convert json value to pk field by schema kind.
+func jsonField(f *jx.SchemaField, v interface{}) (interface{}, error) {
+	switch value := v.(type) {
+	case nil:
+		return zeroField(f)
+	case json.Number:
+		switch f.Kind {
+		case "int", "uint", "float":
+			return parseField(f, value.String())
+		}
+	case string:
+		switch f.Kind {
+		case "string", "time":
+			return parseField(f, value)
+		}
+	case []interface{}:
+		if f.Kind == "bytes" {
+			b := make([]byte, len(value))
+			for i, item := range value {
+				n, ok := item.(json.Number)
+				if !ok {
+					return nil, fmt.Errorf("pk field %s need bytes", f.Json)
+				}
+				u, e := strconv.ParseUint(n.String(), 10, 8)
+				if e != nil {
+					return nil, e
+				}
+				b[i] = byte(u)
+			}
+			return byteArray(f, b)
+		}
+	}
+	return nil, fmt.Errorf("pk field %s need %s : %v", f.Json, f.Kind, v)
+}
+
+// zero pk field value by schema kind.
+func zeroField(f *jx.SchemaField) (interface{}, error) {
+	switch f.Kind {
+	case "string":
+		return "", nil
+	case "int":
+		return int64(0), nil
+	case "uint":
+		return uint64(0), nil
+	case "float":
+		return float64(0), nil
+	case "time":
+		return time.Time{}, nil
+	case "bytes":
+		return byteArray(f, make([]byte, f.Size))
+	}
+	return nil, fmt.Errorf("pk field kind %s is unknown : %s", f.Kind, f.Name)
+}
+
+// make byte array in schema size.
+func byteArray(f *jx.SchemaField, b []byte) (interface{}, error) {
+	if len(b) != f.Size {
+		return nil, fmt.Errorf("pk field %s need %d bytes", f.Json, f.Size)
+	}
+	rv := reflect.New(reflect.ArrayOf(f.Size, reflect.TypeOf(byte(0)))).Elem()
+	reflect.Copy(rv, reflect.ValueOf(b))
+	return rv.Interface(), nil
+}
+
+// get expiration unix nanoseconds from json value.
+// time kind is RFC3339 string, int kind is unix seconds.
+func jsonExpire(f *jx.SchemaField, v interface{}) (exp int64, e error) {
+	switch value := v.(type) {
+	case string:
+		t, e := time.Parse(time.RFC3339Nano, value)
+		if e != nil || t.IsZero() {
+			return 0, e
+		}
+		exp = t.UnixNano()
+	case json.Number:
+		n, e := value.Int64()
+		if e != nil {
+			return 0, e
+		}
+		exp = n * int64(time.Second)
+	}
+	return
+}
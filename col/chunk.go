@@ -1,11 +1,14 @@
 package col
 
 import (
+	"bufio"
 	"bytes"
+	"context"
 	"encoding/json"
 	"fmt"
 	"github.com/Unknwon/com"
 	"io"
+	"io/ioutil"
 	"math/rand"
 	"os"
 	"path"
@@ -13,6 +16,8 @@ import (
 	"reflect"
 	"strconv"
 	"strings"
+	"sync"
+	"time"
 )
 
 type Chunk struct {
@@ -27,6 +32,23 @@ type Chunk struct {
 
 	dataType reflect.Type
 	data     map[int]map[int64]interface{}
+
+	// cursors whose memory data are changed from file by deleting or updating.
+	dirty map[int]bool
+
+	// tolerant loading skips and quarantines broken frames.
+	tolerant     bool
+	onQuarantine func(q *Quarantine)
+	quarantined  []*Quarantine
+
+	hooks ChunkHooks
+
+	// read-only loading never changes files, such as truncating torn frames or replacing optimized files.
+	readOnly bool
+
+	// lock for getting data by concurrent readers,
+	// as it may read cursor file to memory.
+	lock sync.Mutex
 }
 
 // get chunk directory.
@@ -39,8 +61,26 @@ func (c *Chunk) GetCurrent() int {
 	return c.current
 }
 
+// sync and close all opened files.
+func (c *Chunk) Close() (e error) {
+	for i, f := range c.files {
+		if !c.readOnly {
+			if e = f.Sync(); e != nil {
+				return
+			}
+		}
+		if e = f.Close(); e != nil {
+			return
+		}
+		delete(c.files, i)
+	}
+	return
+}
+
 // get data by pkValue.
 func (c *Chunk) Get(pk *PkValue) (v interface{}, e error) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
 	if _, ok := c.data[pk.Cursor]; !ok {
 		// read cursor file if not loaded
 		e = c.ReadCursorFile(pk.Cursor, false)
@@ -53,7 +93,9 @@ func (c *Chunk) Get(pk *PkValue) (v interface{}, e error) {
 	return
 }
 
-// delete data by pkValue
+// delete data by pkValue.
+// it writes an empty frame with same uid as delete mark,
+// so deleted data is known when rebuilding pk.
 func (c *Chunk) Delete(pk *PkValue) (e error) {
 	if _, ok := c.data[pk.Cursor]; !ok {
 		// read cursor file if not loaded
@@ -62,8 +104,12 @@ func (c *Chunk) Delete(pk *PkValue) (e error) {
 			return
 		}
 	}
+	if e = c.writeBytesWithUid(c.files[pk.Cursor], pk.Uid, nil); e != nil {
+		return
+	}
 	// delete in memory item
 	delete(c.data[pk.Cursor], pk.Uid)
+	c.dirty[pk.Cursor] = true
 	return
 }
 
@@ -74,10 +120,18 @@ func (c *Chunk) ReadCursorFile(i int, asCurrent bool) (e error) {
 	// create file handler
 	file := c.GetFile(i)
 	if !com.IsFile(file) {
-		e = fmt.Errorf("file is missing : %s", file)
+		e = fmt.Errorf("%w : %s", ErrFileMissing, file)
 		return
 	}
-	c.files[i], e = os.OpenFile(file, os.O_APPEND|os.O_RDWR, os.ModePerm)
+	start := time.Now()
+	if c.files[i] != nil {
+		c.files[i].Close()
+	}
+	if c.readOnly {
+		c.files[i], e = os.Open(readableFile(file))
+	} else {
+		c.files[i], e = os.OpenFile(file, os.O_APPEND|os.O_RDWR, os.ModePerm)
+	}
 	if e != nil {
 		return
 	}
@@ -89,42 +143,118 @@ func (c *Chunk) ReadCursorFile(i int, asCurrent bool) (e error) {
 		if asCurrent {
 			c.current = i
 		}
+		if c.hooks.Load != nil {
+			c.hooks.Load(i, len(mapData), time.Since(start))
+		}
 	}
-	//println("read chunk : @", i, "of", len(mapData), "items")
 	return
 }
 
 // use file handler to read all data in this file.
 // return a map result or error.
+// torn frame at file end is crash when writing, it's truncated so new frames are appended after good frames.
+// broken frame length in the middle of file is skipped to next valid frame in tolerant loading,
+// file is not changed, as frames after it are good.
+// in tolerant loading, broken frames are quarantined and skipped.
+// read-only loading skips torn frame at file end without truncating.
 func (c *Chunk) readFileHandler(f *os.File) (result map[int64]interface{}, e error) {
 	result = make(map[int64]interface{})
-	for {
-		// read head and uid head
-		head := make([]byte, 8)
-		if _, e = f.Read(head); e != nil {
-			return
+	b, e := ioutil.ReadAll(f)
+	if e != nil {
+		return
+	}
+	size := int64(len(b))
+	var offset int64
+	for offset < size {
+		// check frame head and length
+		fe := &FrameError{File: f.Name(), Offset: offset, Size: size - offset, Truncated: true}
+		if size-offset < 16 {
+			fe.Reason = "truncated frame head"
+		} else if length := bytesToInt64(b[offset:]); length < 0 {
+			fe.Truncated = false
+			fe.Reason = "corrupt frame length"
+		} else if length > size-offset-16 {
+			fe.Reason = "truncated frame value"
 		}
-		uidHead := make([]byte, 8)
-		if _, e = f.Read(uidHead); e != nil {
+		if fe.Reason != "" {
+			// valid frame after broken length means it's not crash tail
+			if next := c.nextFrame(b, offset+1); next < size {
+				fe.Size = next - offset
+				fe.Truncated = false
+				fe.Reason = "corrupt frame length"
+				if !c.tolerant {
+					return nil, fe
+				}
+				if e = c.quarantine(fe, b[offset:next]); e != nil {
+					return
+				}
+				offset = next
+				continue
+			}
+			if c.tolerant {
+				if e = c.quarantine(fe, b[offset:]); e != nil {
+					return
+				}
+			} else if !fe.Truncated {
+				return nil, fe
+			}
+			// torn frame runs to file end, truncate file so new frames are appended after good frames
+			if !c.readOnly {
+				e = f.Truncate(offset)
+			}
 			return
 		}
 
 		// read data
-		data := make([]byte, bytesToInt64(head))
-		if _, e = f.Read(data); e != nil {
-			return
+		length := bytesToInt64(b[offset:])
+		uid := bytesToInt64(b[offset+8:])
+		data := b[offset+16 : offset+16+length]
+		frame := b[offset : offset+16+length]
+		offset += 16 + length
+
+		// empty data is delete mark
+		if len(data) == 0 {
+			delete(result, uid)
+			continue
 		}
 
 		v := reflect.New(c.dataType).Interface()
 		if e = json.Unmarshal(data, v); e != nil {
-			return
+			if !c.tolerant {
+				return
+			}
+			fe := &FrameError{File: f.Name(), Offset: offset - int64(len(frame)), Size: int64(len(frame)), Reason: e.Error()}
+			if e = c.quarantine(fe, frame); e != nil {
+				return
+			}
+			continue
 		}
 
-		result[bytesToInt64(uidHead)] = v
+		result[uid] = v
 	}
 	return
 }
 
+// find offset of next valid frame from offset, or size of b if not found.
+// valid frame has positive length in file and value decoded to data type.
+func (c *Chunk) nextFrame(b []byte, offset int64) int64 {
+	size := int64(len(b))
+	for ; offset+16 < size; offset++ {
+		length := bytesToInt64(b[offset:])
+		if length <= 0 || length > size-offset-16 {
+			continue
+		}
+		data := b[offset+16 : offset+16+length]
+		if !json.Valid(data) {
+			continue
+		}
+		if json.Unmarshal(data, reflect.New(c.dataType).Interface()) == nil {
+			return offset
+		}
+	}
+	return size
+}
+
 // write data into chunk file.
 // it returns an unique id for this value bytes.
 // it encodes value by json.
@@ -141,14 +271,80 @@ func (c *Chunk) Write(v interface{}) (uid int64, cursor int, e error) {
 	c.data[cursor][uid] = v
 	// try move to next if over limit
 	if c.limit < len(c.data[c.current]) {
-		// sync current file
-		c.files[c.current].Sync()
+		e = c.moveNext()
+	}
+	return
+}
 
-		// rand a new cursor as current
-		c.randCursor()
-		c.files[c.current], e = os.OpenFile(c.GetFile(c.current), os.O_CREATE|os.O_APPEND|os.O_RDWR, os.ModePerm)
-		c.data[c.current] = make(map[int64]interface{})
-		//println("move to ", c.current)
+// write many data into chunk files.
+// data in same file are written in one buffer, and synced once,
+// so batch costs one fsync for each written file, usually one.
+// it returns unique ids and cursors in order of values.
+func (c *Chunk) WriteMany(values []interface{}) (uids []int64, cursors []int, e error) {
+	// encode all first, write nothing if any is wrong
+	encoded := make([][]byte, len(values))
+	for i, v := range values {
+		if encoded[i], e = json.Marshal(v); e != nil {
+			return
+		}
+	}
+
+	uids = make([]int64, len(values))
+	cursors = make([]int, len(values))
+	buffers := make(map[int]*bytes.Buffer)
+	counts := make(map[int]int)
+	var order []int
+	for i, b := range encoded {
+		cursor := c.current
+		if buffers[cursor] == nil {
+			buffers[cursor] = new(bytes.Buffer)
+			order = append(order, cursor)
+		}
+		uids[i] = rand.Int63()
+		cursors[i] = cursor
+		writeFrame(buffers[cursor], uids[i], b)
+		counts[cursor]++
+		// try move to next if over limit
+		// full file is synced after writing buffer
+		if c.limit < len(c.data[cursor])+counts[cursor] {
+			if e = c.rollover(); e != nil {
+				return
+			}
+		}
+	}
+
+	for _, cursor := range order {
+		if _, e = c.files[cursor].Write(buffers[cursor].Bytes()); e != nil {
+			return
+		}
+		if e = c.files[cursor].Sync(); e != nil {
+			return
+		}
+	}
+	for i, v := range values {
+		c.data[cursors[i]][uids[i]] = v
+	}
+	return
+}
+
+// sync current file and move to new random cursor file.
+func (c *Chunk) moveNext() (e error) {
+	// sync current file
+	if e = c.files[c.current].Sync(); e != nil {
+		return
+	}
+	e = c.rollover()
+	return
+}
+
+// move to new random cursor file without syncing current file.
+func (c *Chunk) rollover() (e error) {
+	// rand a new cursor as current
+	c.randCursor()
+	c.files[c.current], e = os.OpenFile(c.GetFile(c.current), os.O_CREATE|os.O_APPEND|os.O_RDWR, os.ModePerm)
+	c.data[c.current] = make(map[int64]interface{})
+	if e == nil && c.hooks.Rollover != nil {
+		c.hooks.Rollover(c.current)
 	}
 	return
 }
@@ -178,7 +374,89 @@ func (c *Chunk) Update(v interface{}, pk *PkValue) (e error) {
 	delete(c.data[pk.Cursor], pk.Uid)
 	pk.Uid = uid
 	c.data[pk.Cursor][uid] = v
+	c.dirty[pk.Cursor] = true
+
+	return
+}
+
+// update many data by pkValues.
+// data in same file are written in one buffer, and synced once,
+// so batch costs one fsync for each written file.
+// update pkValues with new uids.
+func (c *Chunk) UpdateMany(values []interface{}, pks []*PkValue) (e error) {
+	encoded := make([][]byte, len(values))
+	for i, v := range values {
+		if _, ok := c.data[pks[i].Cursor]; !ok {
+			// read cursor file if not loaded
+			if e = c.ReadCursorFile(pks[i].Cursor, false); e != nil {
+				return
+			}
+		}
+		if encoded[i], e = json.Marshal(v); e != nil {
+			return
+		}
+	}
+
+	uids := make([]int64, len(values))
+	buffers := make(map[int]*bytes.Buffer)
+	for i, b := range encoded {
+		cursor := pks[i].Cursor
+		if buffers[cursor] == nil {
+			buffers[cursor] = new(bytes.Buffer)
+		}
+		uids[i] = rand.Int63()
+		writeFrame(buffers[cursor], uids[i], b)
+	}
+	for cursor, buf := range buffers {
+		if _, e = c.files[cursor].Write(buf.Bytes()); e != nil {
+			return
+		}
+		if e = c.files[cursor].Sync(); e != nil {
+			return
+		}
+	}
+
+	// update pkValues and change in memory
+	for i, v := range values {
+		delete(c.data[pks[i].Cursor], pks[i].Uid)
+		pks[i].Uid = uids[i]
+		c.data[pks[i].Cursor][uids[i]] = v
+		c.dirty[pks[i].Cursor] = true
+	}
+	return
+}
 
+// delete many values by pkValues.
+// delete marks in same file are written in one buffer, and synced once,
+// so batch costs one fsync for each written file.
+func (c *Chunk) DeleteMany(pks []*PkValue) (e error) {
+	buffers := make(map[int]*bytes.Buffer)
+	for _, pk := range pks {
+		if _, ok := c.data[pk.Cursor]; !ok {
+			// read cursor file if not loaded
+			if e = c.ReadCursorFile(pk.Cursor, false); e != nil {
+				return
+			}
+		}
+		if buffers[pk.Cursor] == nil {
+			buffers[pk.Cursor] = new(bytes.Buffer)
+		}
+		writeFrame(buffers[pk.Cursor], pk.Uid, nil)
+	}
+	for cursor, buf := range buffers {
+		if _, e = c.files[cursor].Write(buf.Bytes()); e != nil {
+			return
+		}
+		if e = c.files[cursor].Sync(); e != nil {
+			return
+		}
+	}
+
+	// delete in memory items
+	for _, pk := range pks {
+		delete(c.data[pk.Cursor], pk.Uid)
+		c.dirty[pk.Cursor] = true
+	}
 	return
 }
 
@@ -193,13 +471,96 @@ func (c *Chunk) writeBytes(cursor int, b []byte) (uid int64, e error) {
 // write bytes to file with unique id.
 func (c *Chunk) writeBytesWithUid(writer *os.File, uid int64, b []byte) (e error) {
 	var buf bytes.Buffer
+	writeFrame(&buf, uid, b)
+	_, e = writer.Write(buf.Bytes())
+	return
+}
+
+// write bytes with header and unique id to buffer.
+func writeFrame(buf *bytes.Buffer, uid int64, b []byte) {
 	buf.Write(int64ToBytes(int64(len(b))))
 	buf.Write(int64ToBytes(uid))
 	buf.Write(b)
-	_, e = writer.Write(buf.Bytes())
+}
+
+// read all cursor files not loaded to memory.
+func (c *Chunk) ReadAll() (e error) {
+	files, e := c.Files()
+	if e != nil {
+		return
+	}
+	for file := range files {
+		cursor, ok := c.cursorOf(file)
+		if !ok {
+			continue
+		}
+		if _, ok := c.data[cursor]; ok {
+			continue
+		}
+		if e = c.ReadCursorFile(cursor, false); e != nil {
+			return e
+		}
+	}
+	return
+}
+
+// get all cursor files and their sizes.
+// optimized .opm files are not included.
+func (c *Chunk) Files() (files map[string]int64, e error) {
+	names, e := filepath.Glob(filepath.Join(c.directory, c.prefix+"*"+c.ext))
+	if e != nil {
+		return
+	}
+	files = make(map[string]int64)
+	for _, name := range names {
+		fi, e := os.Stat(name)
+		if e != nil {
+			return nil, e
+		}
+		files[name] = fi.Size()
+	}
+	return
+}
+
+// read cursor file as current.
+// if the file is missing, such as no data is written, use last modified cursor file or create new one.
+func (c *Chunk) ReadCurrent(cursor int) (e error) {
+	if com.IsFile(c.GetFile(cursor)) {
+		return c.ReadCursorFile(cursor, true)
+	}
+	files, e := c.Files()
+	if e != nil {
+		return
+	}
+	var last os.FileInfo
+	for file := range files {
+		fi, e := os.Stat(file)
+		if e != nil {
+			return e
+		}
+		if i, ok := c.cursorOf(file); ok && (last == nil || fi.ModTime().After(last.ModTime())) {
+			cursor, last = i, fi
+		}
+	}
+	if last != nil {
+		return c.ReadCursorFile(cursor, true)
+	}
+	c.randCursor()
+	c.data[c.current] = make(map[int64]interface{})
+	if c.readOnly {
+		return
+	}
+	c.files[c.current], e = os.OpenFile(c.GetFile(c.current), os.O_CREATE|os.O_APPEND|os.O_RDWR, os.ModePerm)
 	return
 }
 
+// get cursor of file path.
+func (c *Chunk) cursorOf(file string) (cursor int, ok bool) {
+	name := strings.TrimSuffix(strings.TrimPrefix(filepath.Base(file), c.prefix), c.ext)
+	cursor, e := strconv.Atoi(name)
+	return cursor, e == nil
+}
+
 // get cursor file path.
 func (c *Chunk) GetFile(i int) string {
 	return path.Join(c.directory, c.prefix+strconv.Itoa(i)+c.ext)
@@ -239,6 +600,10 @@ func (c *Chunk) init() (e error) {
 // try optimized means replace data file with .opm file,
 // if the .opm file is newer than data file, comparing modification time.
 func (c *Chunk) tryOptimized() (e error) {
+	// temp files of canceled optimizing are useless
+	if e = removeFiles(filepath.Join(c.directory, "*.opm.tmp")); e != nil {
+		return
+	}
 	files, e := filepath.Glob(filepath.Join(c.directory, "*.opm"))
 	if e != nil {
 		return
@@ -271,35 +636,73 @@ func (c *Chunk) tryOptimized() (e error) {
 	return
 }
 
+// delete memory data not pointed by pkValues,
+// such as old values of updated data read from files,
+// so they are cleaned in optimizing.
+func (c *Chunk) Retain(pks []*PkValue) {
+	live := make(map[int]map[int64]bool)
+	for _, pk := range pks {
+		if live[pk.Cursor] == nil {
+			live[pk.Cursor] = make(map[int64]bool)
+		}
+		live[pk.Cursor][pk.Uid] = true
+	}
+	for cursor, data := range c.data {
+		for uid := range data {
+			if !live[cursor][uid] {
+				delete(data, uid)
+				c.dirty[cursor] = true
+			}
+		}
+	}
+}
+
 // optimize chunk data.
 // it pulls all memory data to opm file.
 // notice just loaded chunk file will be optimized.
 func (c *Chunk) Optimize() (e error) {
+	return c.OptimizeContext(context.Background())
+}
+
+// optimize chunk data until ctx is canceled.
+// each opm file is written by temp file and renamed, so canceling leaves no half written opm file,
+// opm files written before canceling are kept.
+func (c *Chunk) OptimizeContext(ctx context.Context) (e error) {
 	for cursor, data := range c.data {
-		// if < 10% items, no need to optimize
-		if len(data) < c.limit/10 {
+		if e = ctx.Err(); e != nil {
+			return
+		}
+		// if < 10% items and nothing deleted, no need to optimize
+		if len(data) < c.limit/10 && !c.dirty[cursor] {
 			continue
 		}
-		opmFile := c.GetFile(cursor) + ".opm"
-		fileWriter, e := os.OpenFile(opmFile, os.O_CREATE|os.O_TRUNC|os.O_RDWR, os.ModePerm)
+		e = writeOptimized(ctx, c.GetFile(cursor)+".opm", func(f *os.File) error {
+			w := bufio.NewWriter(f)
+			var buf bytes.Buffer
+			for uid, v := range data {
+				if e := ctx.Err(); e != nil {
+					return e
+				}
+				// encode
+				b, e := json.Marshal(v)
+				if e != nil {
+					return e
+				}
+				buf.Reset()
+				writeFrame(&buf, uid, b)
+				if _, e = w.Write(buf.Bytes()); e != nil {
+					return e
+				}
+			}
+			return w.Flush()
+		})
 		if e != nil {
-			return e
+			return
 		}
-		for uid, v := range data {
-			// encode
-			bytes, e := json.Marshal(v)
-			if e != nil {
-				return e
-			}
-			// write to file
-			e = c.writeBytesWithUid(fileWriter, uid, bytes)
-			if e != nil {
-				return e
-			}
+		delete(c.dirty, cursor)
+		if c.hooks.Compact != nil {
+			c.hooks.Compact(cursor)
 		}
-		// do not keep file handler
-		fileWriter.Sync()
-		fileWriter.Close()
 	}
 	return
 }
@@ -315,7 +718,30 @@ func NewChunk(directory, prefix, ext string, limit int, dataType reflect.Type) (
 		limit:     limit,
 		dataType:  dataType,
 		data:      make(map[int]map[int64]interface{}),
+		dirty:     make(map[int]bool),
 	}
 	e = c.init()
 	return
 }
+
+// create read-only chunk to read data without changing files,
+// such as reading directory opened by running program.
+// data can't be written to read-only chunk.
+func NewReadOnlyChunk(directory, prefix, ext string, limit int, dataType reflect.Type) (c *Chunk, e error) {
+	if !com.IsDir(directory) {
+		e = fmt.Errorf("%w : %s", ErrFileMissing, directory)
+		return
+	}
+	c = &Chunk{
+		directory: directory,
+		prefix:    prefix,
+		ext:       ext,
+		files:     make(map[int]*os.File),
+		limit:     limit,
+		dataType:  dataType,
+		data:      make(map[int]map[int64]interface{}),
+		dirty:     make(map[int]bool),
+		readOnly:  true,
+	}
+	return
+}
@@ -0,0 +1,130 @@
+package col
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"sort"
+)
+
+// ErrFileMissing means chunk file pointed by pk is missing.
+var ErrFileMissing = errors.New("file is missing")
+
+// Frame is one value in chunk file or pk file.
+// pk file frame has no uid.
+// deleted frame is delete mark of chunk data with same uid.
+type Frame struct {
+	File    string
+	Cursor  int
+	Offset  int64
+	Uid     int64
+	Data    []byte
+	Deleted bool
+}
+
+// FrameError is broken frame in file.
+// truncated frame runs out of file end, such as crash when writing.
+// frames after broken frame in same file can't be read.
+type FrameError struct {
+	File      string
+	Offset    int64
+	Size      int64
+	Truncated bool
+	Reason    string
+}
+
+// error message with file and offset.
+func (f *FrameError) Error() string {
+	return fmt.Sprintf("%s at %s:%d", f.Reason, f.File, f.Offset)
+}
+
+// walk frames in all cursor files from disk, in cursor order.
+// broken frames are returned, one for each file at most.
+func (c *Chunk) WalkFrames(fn func(f *Frame) error) (broken []*FrameError, e error) {
+	files, e := c.Files()
+	if e != nil {
+		return
+	}
+	cursors := make([]int, 0, len(files))
+	for file := range files {
+		if cursor, ok := c.cursorOf(file); ok {
+			cursors = append(cursors, cursor)
+		}
+	}
+	sort.Ints(cursors)
+	for _, cursor := range cursors {
+		fe, e := walkFrames(c.GetFile(cursor), cursor, true, fn)
+		if e != nil {
+			return nil, e
+		}
+		if fe != nil {
+			broken = append(broken, fe)
+		}
+	}
+	return
+}
+
+// walk frames in pk file from disk.
+func (p *PK) WalkFrames(fn func(f *Frame) error) (broken *FrameError, e error) {
+	return walkFrames(path.Join(p.directory, "pk.pk"), 0, false, fn)
+}
+
+// walk frames in file.
+// frame is [length 8][uid 8][data], no uid in pk file.
+// it stops at broken frame and returns it.
+func walkFrames(file string, cursor int, withUid bool, fn func(f *Frame) error) (broken *FrameError, e error) {
+	f, e := os.Open(file)
+	if e != nil {
+		return
+	}
+	defer f.Close()
+	fi, e := f.Stat()
+	if e != nil {
+		return
+	}
+	size := fi.Size()
+	headSize := int64(8)
+	if withUid {
+		headSize = 16
+	}
+
+	r := bufio.NewReader(f)
+	head := make([]byte, headSize)
+	var offset int64
+	for offset < size {
+		broken = &FrameError{File: file, Offset: offset, Size: size - offset, Truncated: true}
+		if size-offset < headSize {
+			broken.Reason = "truncated frame head"
+			return
+		}
+		if _, e = io.ReadFull(r, head); e != nil {
+			return nil, e
+		}
+		length := bytesToInt64(head[:8])
+		if length < 0 {
+			broken.Truncated = false
+			broken.Reason = "corrupt frame length"
+			return
+		}
+		if length > size-offset-headSize {
+			broken.Reason = "truncated frame value"
+			return
+		}
+		frame := &Frame{File: file, Cursor: cursor, Offset: offset, Data: make([]byte, length)}
+		if withUid {
+			frame.Uid = bytesToInt64(head[8:])
+			frame.Deleted = length == 0
+		}
+		if _, e = io.ReadFull(r, frame.Data); e != nil {
+			return nil, e
+		}
+		if e = fn(frame); e != nil {
+			return nil, e
+		}
+		offset += headSize + length
+	}
+	return nil, nil
+}
@@ -0,0 +1,21 @@
+package col
+
+import (
+	"time"
+)
+
+// ChunkHooks are called on chunk events, for logging and metrics.
+// nil hook is not called.
+type ChunkHooks struct {
+	// cursor file is loaded to memory with values count.
+	Load func(cursor int, values int, d time.Duration)
+	// current file is full, new cursor file is created as current.
+	Rollover func(cursor int)
+	// cursor file is compacted to optimized file.
+	Compact func(cursor int)
+}
+
+// set chunk hooks.
+func (c *Chunk) SetHooks(hooks ChunkHooks) {
+	c.hooks = hooks
+}
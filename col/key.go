@@ -0,0 +1,283 @@
+package col
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"math"
+	"reflect"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// type tags of key fields.
+// each field is encoded as tag byte and order-preserving bytes,
+// so key bytes order is same as typed pk order.
+const (
+	keyTagString byte = 0x10
+	keyTagInt    byte = 0x20
+	keyTagUint   byte = 0x21
+	keyTagFloat  byte = 0x30
+	keyTagTime   byte = 0x40
+	keyTagBytes  byte = 0x50
+)
+
+const (
+	keyEscape     = 0x00
+	keyEscaped    = 0xff
+	keyTerminator = 0x01
+
+	// fixed width utc time, used by legacy string keys.
+	keyTimeLayout = "2006-01-02T15:04:05.000000000Z"
+)
+
+var (
+	PkInvalid = errors.New("pk invalid")
+
+	timeType = reflect.TypeOf(time.Time{})
+)
+
+// encode pk value to key bytes.
+// composite pk ([]interface{}) encodes every field in order.
+func EncodeKey(pk interface{}) (key []byte, e error) {
+	if fields, ok := pk.([]interface{}); ok {
+		return EncodeKeyFields(fields)
+	}
+	return EncodeKeyFields([]interface{}{pk})
+}
+
+// encode pk fields to key bytes.
+// the leading fields of one key are always prefix of the key.
+func EncodeKeyFields(fields []interface{}) (key []byte, e error) {
+	var buf bytes.Buffer
+	for _, f := range fields {
+		if e = encodeKeyField(&buf, reflect.ValueOf(f)); e != nil {
+			return
+		}
+	}
+	key = buf.Bytes()
+	return
+}
+
+// encode one pk field value to buffer.
+func encodeKeyField(buf *bytes.Buffer, rv reflect.Value) (e error) {
+	if !rv.IsValid() {
+		return PkInvalid
+	}
+	b := make([]byte, 8)
+	if rv.Type() == timeType {
+		t := rv.Interface().(time.Time)
+		buf.WriteByte(keyTagTime)
+		binary.BigEndian.PutUint64(b, uint64(t.Unix())^(1<<63))
+		buf.Write(b)
+		binary.BigEndian.PutUint32(b, uint32(t.Nanosecond()))
+		buf.Write(b[:4])
+		return
+	}
+	switch rv.Kind() {
+	case reflect.String:
+		buf.WriteByte(keyTagString)
+		for _, c := range []byte(rv.String()) {
+			buf.WriteByte(c)
+			if c == keyEscape {
+				buf.WriteByte(keyEscaped)
+			}
+		}
+		buf.WriteByte(keyEscape)
+		buf.WriteByte(keyTerminator)
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		buf.WriteByte(keyTagInt)
+		binary.BigEndian.PutUint64(b, uint64(rv.Int())^(1<<63))
+		buf.Write(b)
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		buf.WriteByte(keyTagUint)
+		binary.BigEndian.PutUint64(b, rv.Uint())
+		buf.Write(b)
+	case reflect.Float32, reflect.Float64:
+		f := rv.Float()
+		if math.IsNaN(f) {
+			return PkInvalid
+		}
+		if f == 0 {
+			// -0 is same as 0
+			f = 0
+		}
+		bits := math.Float64bits(f)
+		if f < 0 {
+			bits = ^bits
+		} else {
+			bits |= 1 << 63
+		}
+		buf.WriteByte(keyTagFloat)
+		binary.BigEndian.PutUint64(b, bits)
+		buf.Write(b)
+	case reflect.Array:
+		if rv.Type().Elem().Kind() != reflect.Uint8 {
+			return PkInvalid
+		}
+		buf.WriteByte(keyTagBytes)
+		binary.BigEndian.PutUint32(b, uint32(rv.Len()))
+		buf.Write(b[:4])
+		for i := 0; i < rv.Len(); i++ {
+			buf.WriteByte(byte(rv.Index(i).Uint()))
+		}
+	default:
+		return PkInvalid
+	}
+	return
+}
+
+// decode key bytes to pk fields.
+// int fields are int64, uint fields are uint64,
+// time fields are utc time.Time, byte array fields are []byte.
+func DecodeKey(key []byte) (fields []interface{}, e error) {
+	for len(key) > 0 {
+		tag := key[0]
+		key = key[1:]
+		switch tag {
+		case keyTagString:
+			var buf bytes.Buffer
+			i := 0
+			for ; i+1 < len(key); i++ {
+				if key[i] != keyEscape {
+					buf.WriteByte(key[i])
+					continue
+				}
+				if key[i+1] == keyTerminator {
+					break
+				}
+				buf.WriteByte(keyEscape)
+				i++
+			}
+			if i+1 >= len(key) {
+				return nil, PkInvalid
+			}
+			fields = append(fields, buf.String())
+			key = key[i+2:]
+		case keyTagInt, keyTagUint, keyTagFloat:
+			if len(key) < 8 {
+				return nil, PkInvalid
+			}
+			u := binary.BigEndian.Uint64(key)
+			switch tag {
+			case keyTagInt:
+				fields = append(fields, int64(u^(1<<63)))
+			case keyTagUint:
+				fields = append(fields, u)
+			default:
+				if u&(1<<63) != 0 {
+					u &^= 1 << 63
+				} else {
+					u = ^u
+				}
+				fields = append(fields, math.Float64frombits(u))
+			}
+			key = key[8:]
+		case keyTagTime:
+			if len(key) < 12 {
+				return nil, PkInvalid
+			}
+			sec := int64(binary.BigEndian.Uint64(key) ^ (1 << 63))
+			nsec := int64(binary.BigEndian.Uint32(key[8:]))
+			fields = append(fields, time.Unix(sec, nsec).UTC())
+			key = key[12:]
+		case keyTagBytes:
+			if len(key) < 4 {
+				return nil, PkInvalid
+			}
+			l := int(binary.BigEndian.Uint32(key))
+			if len(key) < 4+l {
+				return nil, PkInvalid
+			}
+			fields = append(fields, append([]byte(nil), key[4:4+l]...))
+			key = key[4+l:]
+		default:
+			return nil, PkInvalid
+		}
+	}
+	return
+}
+
+// parse legacy string key to typed key bytes.
+// legacy keys are fmt.Sprint of single pk,
+// or escaped and terminated strings of composite pk fields.
+func parseLegacyKey(s string, types []reflect.Type) (key []byte, e error) {
+	parts := []string{s}
+	if len(types) > 1 {
+		parts = splitLegacyKey(s)
+	}
+	if len(parts) != len(types) {
+		e = fmt.Errorf("legacy pk %q need %d fields", s, len(types))
+		return
+	}
+	fields := make([]interface{}, len(types))
+	for i, rt := range types {
+		rv := reflect.New(rt).Elem()
+		if e = parseLegacyField(parts[i], rv); e != nil {
+			e = fmt.Errorf("legacy pk %q : %s", s, e.Error())
+			return
+		}
+		fields[i] = rv.Interface()
+	}
+	return EncodeKeyFields(fields)
+}
+
+// split legacy composite key to field strings.
+func splitLegacyKey(s string) (parts []string) {
+	var buf bytes.Buffer
+	for i := 0; i < len(s); i++ {
+		if s[i] != keyEscape || i+1 >= len(s) {
+			buf.WriteByte(s[i])
+			continue
+		}
+		i++
+		if s[i] == keyTerminator {
+			parts = append(parts, buf.String())
+			buf.Reset()
+			continue
+		}
+		buf.WriteByte(keyEscape)
+	}
+	return
+}
+
+// parse legacy field string to typed value.
+func parseLegacyField(s string, rv reflect.Value) (e error) {
+	if rv.Type() == timeType {
+		var t time.Time
+		if t, e = time.Parse(keyTimeLayout, s); e == nil {
+			rv.Set(reflect.ValueOf(t))
+		}
+		return
+	}
+	switch rv.Kind() {
+	case reflect.String:
+		rv.SetString(s)
+	case reflect.Int, reflect.Int32, reflect.Int64:
+		var i int64
+		if i, e = strconv.ParseInt(s, 10, 64); e == nil {
+			rv.SetInt(i)
+		}
+	case reflect.Uint32, reflect.Uint64:
+		var u uint64
+		if u, e = strconv.ParseUint(s, 10, 64); e == nil {
+			rv.SetUint(u)
+		}
+	case reflect.Float64:
+		var f float64
+		if f, e = strconv.ParseFloat(strings.TrimSpace(s), 64); e == nil {
+			rv.SetFloat(f)
+		}
+	case reflect.Array:
+		var b []byte
+		if b, e = hex.DecodeString(s); e == nil {
+			reflect.Copy(rv, reflect.ValueOf(b))
+		}
+	default:
+		e = PkInvalid
+	}
+	return
+}
@@ -0,0 +1,98 @@
+package col
+
+import (
+	"bytes"
+	"encoding/json"
+	"math"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestKeyOrder(t *testing.T) {
+	ordered := [][]interface{}{
+		{int64(math.MinInt64), int64(-10), int64(-1), int64(0), int64(9), int64(10), int64(math.MaxInt64)},
+		{uint64(0), uint64(9), uint64(10), uint64(math.MaxUint64)},
+		{-math.MaxFloat64, -1e21, -1.5, 0.0, 1e-9, 1.5, 1e21, math.Inf(1)},
+		{"", "\x00", "\x00a", "a", "a\x00", "ab", "b"},
+		{time.Time{}, time.Unix(-1, 0), time.Unix(0, 0), time.Unix(0, 1), time.Unix(1, 0)},
+		{[2]byte{0, 0}, [2]byte{0, 1}, [2]byte{1, 0}},
+	}
+	for _, values := range ordered {
+		var last []byte
+		for i, v := range values {
+			key, e := EncodeKey(v)
+			if e != nil {
+				t.Fatal(e)
+			}
+			if i > 0 && bytes.Compare(last, key) >= 0 {
+				t.Errorf("expect key of %v > key of %v", v, values[i-1])
+			}
+			last = key
+		}
+	}
+}
+
+func TestKeyDecode(t *testing.T) {
+	at := time.Date(2020, 1, 2, 3, 4, 5, 6, time.UTC)
+	fields := []interface{}{"a\x00b", int64(-3), uint64(4), 1.5, at, []byte{1, 2}}
+	key, e := EncodeKeyFields([]interface{}{"a\x00b", -3, uint32(4), 1.5, at, [2]byte{1, 2}})
+	if e != nil {
+		t.Fatal(e)
+	}
+	decoded, e := DecodeKey(key)
+	if e != nil {
+		t.Fatal(e)
+	}
+	if !reflect.DeepEqual(fields, decoded) {
+		t.Errorf("expect %v, but got %v", fields, decoded)
+	}
+
+	// leading fields are prefix of key
+	prefix, _ := EncodeKeyFields([]interface{}{"a\x00b"})
+	if !bytes.HasPrefix(key, prefix) {
+		t.Error("expect leading fields are key prefix")
+	}
+}
+
+func TestPkMigrate(t *testing.T) {
+	dir := t.TempDir()
+	f, e := os.Create(filepath.Join(dir, "pk.pk"))
+	if e != nil {
+		t.Fatal(e)
+	}
+	p := &PK{}
+	for _, v := range []*PkValue{
+		{Value: "a\x00\x01" + "5\x00\x01", Uid: 1, Cursor: 2},
+		{Value: "b\x00\x01" + "6\x00\x01", Uid: 2, Cursor: 2},
+		{Value: "b\x00\x01" + "6\x00\x01", Del: 1},
+	} {
+		b, _ := json.Marshal(v)
+		p.writeBytes(b, f)
+	}
+	f.Close()
+
+	types := []reflect.Type{reflect.TypeOf(""), reflect.TypeOf(uint64(0))}
+	for i := 0; i < 2; i++ {
+		p, e = NewPk(dir, false, types)
+		if e != nil {
+			t.Fatal(e)
+		}
+		v, e := p.Get([]interface{}{"a", uint64(5)})
+		if e != nil {
+			t.Fatal(e)
+		}
+		if v == nil || v.Uid != 1 || v.Cursor != 2 {
+			t.Errorf("expect migrated pk value, but got %v", v)
+		}
+		if v, _ = p.Get([]interface{}{"b", uint64(6)}); v != nil {
+			t.Errorf("expect deleted pk, but got %v", v)
+		}
+		if p.legacy {
+			t.Error("expect migrated pk file")
+		}
+		p.file.Close()
+	}
+}
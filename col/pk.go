@@ -1,23 +1,34 @@
 package col
 
 import (
+	"bufio"
 	"bytes"
+	"context"
 	"encoding/json"
 	"errors"
 	"fmt"
 	"github.com/Unknwon/com"
 	"io"
 	"io/ioutil"
+	"math"
 	"os"
 	"path"
 	"path/filepath"
 	"reflect"
+	"sort"
+	"strconv"
 	"strings"
+	"time"
 )
 
+// AutoBlock is count of auto increment ids reserved in one block.
+// the reserved max id is saved once for each block.
+var AutoBlock int64 = 100
+
 var (
 	PKConflict = errors.New("pk conflict")
 	PkEmpty    = errors.New("pk empty")
+	PkOverflow = errors.New("pk overflow")
 )
 
 type PK struct {
@@ -26,8 +37,15 @@ type PK struct {
 
 	autoFile string
 	autoId   int64
+	autoHigh int64
 	auto     bool
 
+	types  []reflect.Type
+	legacy bool
+
+	// read-only loading never changes files, legacy keys are parsed in memory without migrating.
+	readOnly bool
+
 	data           map[string]*PkValue
 	lastLoadCursor int
 }
@@ -39,50 +57,160 @@ func (p *PK) GetDirectory() string {
 
 // set pk value if auto increment,
 // check pk unique.
-func (p *PK) SetPk(v interface{}, field string) (pk interface{}, e error) {
+// several fields mean composite pk, returned as []interface{}.
+func (p *PK) SetPk(v interface{}, fields ...string) (pk interface{}, e error) {
 	rv := reflect.ValueOf(v).Elem()
-	pk = rv.FieldByName(field).Interface()
-	if _, ok := p.data[fmt.Sprint(pk)]; ok {
+	values := make([]interface{}, len(fields))
+	for i, field := range fields {
+		values[i] = rv.FieldByName(field).Interface()
+	}
+	pk = values[0]
+	if len(values) > 1 {
+		pk = values
+	}
+	key, e := EncodeKey(pk)
+	if e != nil {
+		return
+	}
+	if old, ok := p.data[string(key)]; ok && !p.auto && !old.Expired(time.Now().UnixNano()) {
 		e = PKConflict
 		return
 	}
 	// if pk auto increment, set pk
 	if p.auto {
-		p.autoId++
-		rv.FieldByName(field).SetInt(p.autoId)
-		e = p.WriteIncrement()
-		if e == nil {
-			pk = p.autoId
+		field := rv.FieldByName(fields[0])
+		id := p.autoId + 1
+		switch field.Kind() {
+		case reflect.Uint32, reflect.Uint64:
+			if field.OverflowUint(uint64(id)) {
+				e = PkOverflow
+				return
+			}
+			field.SetUint(uint64(id))
+		default:
+			if field.OverflowInt(id) {
+				e = PkOverflow
+				return
+			}
+			field.SetInt(id)
+		}
+		if e = p.AdvanceAuto(id); e != nil {
+			return
 		}
+		pk = field.Interface()
 	} else {
 		// make sure pk is not empty. but 0 is valid.
-		if fmt.Sprint(pk) == "" {
-			e = PkEmpty
+		for _, value := range values {
+			if rv := reflect.ValueOf(value); rv.Kind() == reflect.String && rv.Len() == 0 {
+				e = PkEmpty
+				return
+			}
+		}
+	}
+	return
+}
+
+// keep explicit auto increment id of value, such as importing.
+// it checks the id is unique, and advances auto increment id past it.
+// zero id is set as next auto increment id.
+func (p *PK) KeepAuto(v interface{}, field string) (pk interface{}, e error) {
+	f := reflect.ValueOf(v).Elem().FieldByName(field)
+	var id int64
+	switch f.Kind() {
+	case reflect.Uint32, reflect.Uint64:
+		if f.Uint() > math.MaxInt64 {
+			e = PkOverflow
 			return
 		}
+		id = int64(f.Uint())
+	default:
+		id = f.Int()
+	}
+	if id == 0 {
+		return p.SetPk(v, field)
 	}
+	if id < 0 {
+		e = PkInvalid
+		return
+	}
+	pk = f.Interface()
+	key, e := EncodeKey(pk)
+	if e != nil {
+		return
+	}
+	if old, ok := p.data[string(key)]; ok && !old.Expired(time.Now().UnixNano()) {
+		e = PKConflict
+		return
+	}
+	e = p.AdvanceAuto(id)
 	return
 }
 
-// write current max id to auto increment file.
+// advance auto increment id to id, if id is larger.
+// reserve next block and save it, if reserved ids are used up.
+func (p *PK) AdvanceAuto(id int64) (e error) {
+	if id <= p.autoId {
+		return
+	}
+	if id > p.autoHigh {
+		high := p.autoHigh
+		p.autoHigh = id + AutoBlock - 1
+		if e = p.WriteIncrement(); e != nil {
+			p.autoHigh = high
+			return
+		}
+	}
+	p.autoId = id
+	return
+}
+
+// write reserved max id to auto increment file atomically.
+// ids are never reused after crash, because reserved max id is saved.
 func (p *PK) WriteIncrement() (e error) {
-	e = ioutil.WriteFile(p.autoFile, int64ToBytes(p.autoId), os.ModePerm)
+	e = writeFileAtomic(p.autoFile, int64ToBytes(p.autoHigh))
 	return
 }
 
 // get pk meta by value.
 func (p *PK) Get(pk interface{}) (v *PkValue, e error) {
-	v = p.data[fmt.Sprint(pk)]
+	key, e := EncodeKey(pk)
+	if e != nil {
+		return
+	}
+	v = p.data[string(key)]
+	return
+}
+
+// get pk meta by key bytes.
+func (p *PK) GetKey(key []byte) *PkValue {
+	return p.data[string(key)]
+}
+
+// get pk metas whose key starts with prefix, sorted by key.
+// empty prefix returns all pk metas.
+func (p *PK) Prefix(prefix []byte) (values []*PkValue) {
+	for key, v := range p.data {
+		if strings.HasPrefix(key, string(prefix)) {
+			values = append(values, v)
+		}
+	}
+	sort.Slice(values, func(i, j int) bool {
+		return bytes.Compare(values[i].Key, values[j].Key) < 0
+	})
 	return
 }
 
 // delete pk meta by value.
 // it writes a deleted pkValue, not deletes old data.
 func (p *PK) Delete(pk interface{}) (e error) {
+	key, e := EncodeKey(pk)
+	if e != nil {
+		return
+	}
 	// write delete mark item
 	pkValue := &PkValue{
-		Value: fmt.Sprint(pk),
-		Del:   1,
+		Key: key,
+		Del: 1,
 	}
 	bytes, e := json.Marshal(pkValue)
 	if e != nil {
@@ -91,13 +219,14 @@ func (p *PK) Delete(pk interface{}) (e error) {
 	e = p.writeBytes(bytes, p.file)
 	if e == nil {
 		// delete in memory
-		delete(p.data, pkValue.Value)
+		delete(p.data, string(key))
 	}
 	return
 }
 
 // read all pk items from file.
 // assign to memory map.
+// legacy string keys are parsed to typed keys, and marked to migrate.
 func (p *PK) Read() (e error) {
 	for {
 		// read head
@@ -117,16 +246,45 @@ func (p *PK) Read() (e error) {
 		if e = json.Unmarshal(data, v); e != nil {
 			return
 		}
+		if v.Key == nil {
+			if v.Key, e = parseLegacyKey(v.Value, p.types); e != nil {
+				return
+			}
+			v.Value = ""
+			p.legacy = true
+		}
+		if p.auto {
+			p.readAutoKey(v.Key)
+		}
 		if v.Del > 0 {
-			delete(p.data, v.Value)
+			delete(p.data, string(v.Key))
 			continue
 		}
-		p.data[v.Value] = v
+		p.data[string(v.Key)] = v
 		p.lastLoadCursor = v.Cursor
 	}
 	return
 }
 
+// keep auto increment id not less than pk in file,
+// including deleted pk.
+func (p *PK) readAutoKey(key []byte) {
+	fields, e := DecodeKey(key)
+	if e != nil || len(fields) != 1 {
+		return
+	}
+	var id int64
+	switch f := fields[0].(type) {
+	case int64:
+		id = f
+	case uint64:
+		id = int64(f)
+	}
+	if id > p.autoId {
+		p.autoId = id
+	}
+}
+
 // read increment max id from file.
 // if current id is larger, keep current.
 func (p *PK) ReadIncrement() (e error) {
@@ -134,6 +292,10 @@ func (p *PK) ReadIncrement() (e error) {
 	if e != nil {
 		return
 	}
+	if len(bytes) < 8 {
+		e = fmt.Errorf("auto increment file is broken : %s", p.autoFile)
+		return
+	}
 	id := bytesToInt64(bytes)
 	if id > p.autoId {
 		p.autoId = id
@@ -144,13 +306,17 @@ func (p *PK) ReadIncrement() (e error) {
 // write pk values to file.
 // cursor means where the data in.
 // uid means the data unique id in chunk file.
-// del means deleted status.
-func (p *PK) Write(pk interface{}, cursor int, uid int64, del int) (e error) {
+// exp means expiration time in unix nanoseconds, 0 is never expired.
+func (p *PK) Write(pk interface{}, cursor int, uid int64, exp int64) (e error) {
+	key, e := EncodeKey(pk)
+	if e != nil {
+		return
+	}
 	pkValue := &PkValue{
+		Key:    key,
 		Cursor: cursor,
-		Del:    del,
 		Uid:    uid,
-		Value:  fmt.Sprint(pk),
+		Exp:    exp,
 	}
 	bytes, e := json.Marshal(pkValue)
 	if e != nil {
@@ -158,7 +324,77 @@ func (p *PK) Write(pk interface{}, cursor int, uid int64, del int) (e error) {
 	}
 	e = p.writeBytes(bytes, p.file)
 	if e == nil {
-		p.data[pkValue.Value] = pkValue
+		p.data[string(key)] = pkValue
+	}
+	return
+}
+
+// write many pk values to file in one appending, and sync file once.
+// write chunk data first, so pk values never point to data not synced.
+// cursors, uids and expiration times are in order of pks.
+func (p *PK) WriteMany(pks []interface{}, cursors []int, uids []int64, exps []int64) (e error) {
+	values := make([]*PkValue, len(pks))
+	for i, pk := range pks {
+		values[i] = &PkValue{
+			Cursor: cursors[i],
+			Uid:    uids[i],
+			Exp:    exps[i],
+		}
+		if values[i].Key, e = EncodeKey(pk); e != nil {
+			return
+		}
+	}
+	e = p.writeValues(values)
+	return
+}
+
+// delete many pk values.
+// it writes deleted pkValues in one appending, and sync file.
+func (p *PK) DeleteMany(pks []interface{}) (e error) {
+	keys := make([][]byte, len(pks))
+	for i, pk := range pks {
+		if keys[i], e = EncodeKey(pk); e != nil {
+			return
+		}
+	}
+	e = p.DeleteKeys(keys)
+	return
+}
+
+// delete many pk values by key bytes.
+func (p *PK) DeleteKeys(keys [][]byte) (e error) {
+	values := make([]*PkValue, len(keys))
+	for i, key := range keys {
+		values[i] = &PkValue{Key: key, Del: 1}
+	}
+	e = p.writeValues(values)
+	return
+}
+
+// write pk values to file in one buffer, and sync file.
+// then assign to memory map.
+func (p *PK) writeValues(values []*PkValue) (e error) {
+	var buf bytes.Buffer
+	for _, v := range values {
+		b, e := json.Marshal(v)
+		if e != nil {
+			return e
+		}
+		buf.Write(int64ToBytes(int64(len(b))))
+		buf.Write(b)
+	}
+	if _, e = p.file.Write(buf.Bytes()); e != nil {
+		return
+	}
+	if e = p.file.Sync(); e != nil {
+		return
+	}
+	for _, v := range values {
+		if v.Del > 0 {
+			delete(p.data, string(v.Key))
+			continue
+		}
+		p.data[string(v.Key)] = v
 	}
 	return
 }
@@ -168,11 +404,11 @@ func (p *PK) Write(pk interface{}, cursor int, uid int64, del int) (e error) {
 // assign new pkValue in memory.
 func (p *PK) Update(pk interface{}, pkV *PkValue) (e error) {
 	// write new value to file
-	if e = p.Write(pk, pkV.Cursor, pkV.Uid, 0); e != nil {
+	if e = p.Write(pk, pkV.Cursor, pkV.Uid, pkV.Exp); e != nil {
 		return
 	}
 	// update memory
-	p.data[pkV.Value] = pkV // todo : maybe no need
+	p.data[string(pkV.Key)] = pkV // todo : maybe no need
 	return
 }
 
@@ -191,11 +427,61 @@ func (p *PK) GetLastCursor() int {
 	return p.lastLoadCursor
 }
 
+// get pk file and auto increment file with their sizes.
+func (p *PK) Files() (files map[string]int64, e error) {
+	files = make(map[string]int64)
+	fi, e := p.file.Stat()
+	if e != nil {
+		return
+	}
+	files[path.Join(p.directory, "pk.pk")] = fi.Size()
+	if p.auto {
+		if fi, e = os.Stat(p.autoFile); e != nil {
+			return
+		}
+		files[p.autoFile] = fi.Size()
+	}
+	return
+}
+
+// get reserved max id saved in auto increment file.
+func (p *PK) SavedAutoIncrement() (id int64, e error) {
+	bytes, e := ioutil.ReadFile(p.autoFile)
+	if e != nil {
+		return
+	}
+	if len(bytes) < 8 {
+		e = fmt.Errorf("auto increment file is broken : %s", p.autoFile)
+		return
+	}
+	id = bytesToInt64(bytes)
+	return
+}
+
 // get current max auto increment int64.
 func (p *PK) GetAutoIncrement() int64 {
 	return p.autoId
 }
 
+// close pk file.
+// save current max id, so next opening continues from it.
+func (p *PK) Close() (e error) {
+	if p.readOnly {
+		return p.file.Close()
+	}
+	if p.auto {
+		p.autoHigh = p.autoId
+		if e = p.WriteIncrement(); e != nil {
+			return
+		}
+	}
+	if e = p.file.Sync(); e != nil {
+		return
+	}
+	e = p.file.Close()
+	return
+}
+
 // init pk data as first running.
 func (p *PK) firstInit() (e error) {
 	// first init
@@ -223,6 +509,9 @@ func (p *PK) firstInit() (e error) {
 // create files in first init.
 // read files after first init.
 func (p *PK) init() (e error) {
+	if p.readOnly {
+		return p.readOnlyInit()
+	}
 	if !com.IsDir(p.directory) {
 		return p.firstInit()
 	}
@@ -247,16 +536,181 @@ func (p *PK) init() (e error) {
 		return
 	}
 	e = p.Read()
-	//println("read pk items :", len(p.data))
 	if e != nil && e != io.EOF {
 		return
 	}
 	e = nil
+	p.autoHigh = p.autoId
+
+	// rewrite legacy string keys to typed keys
+	if p.legacy {
+		e = p.migrate()
+	}
+	return
+}
+
+// init pk by reading files only.
+// newer optimized file is read instead of replacing pk file.
+func (p *PK) readOnlyInit() (e error) {
+	if p.auto {
+		p.autoFile = path.Join(p.directory, "auto.pk")
+		if e = p.ReadIncrement(); e != nil {
+			return
+		}
+	}
+	if p.file, e = os.Open(readableFile(path.Join(p.directory, "pk.pk"))); e != nil {
+		return
+	}
+	e = p.Read()
+	if e != nil && e != io.EOF {
+		p.file.Close()
+		return
+	}
+	e = nil
+	p.autoHigh = p.autoId
+	return
+}
+
+// reset pk values, such as rebuilding from chunk data.
+// pk file is replaced by temp file with all values,
+// auto increment id is advanced past pk values and deleted keys, and saved.
+func (p *PK) Reset(values []*PkValue, deleted [][]byte) (e error) {
+	if e = p.replaceFile(values); e != nil {
+		return
+	}
+	data := make(map[string]*PkValue)
+	for _, pkValue := range values {
+		data[string(pkValue.Key)] = pkValue
+	}
+	p.data = data
+	if len(values) > 0 {
+		p.lastLoadCursor = values[len(values)-1].Cursor
+	}
+	if p.auto {
+		for _, pkValue := range values {
+			p.readAutoKey(pkValue.Key)
+		}
+		for _, key := range deleted {
+			p.readAutoKey(key)
+		}
+		p.autoHigh = p.autoId
+		e = p.WriteIncrement()
+	}
+	return
+}
+
+// reset pk files in directory to empty, so pk can be opened and rebuilt.
+// old pk file is kept as pk.pk.broken, or pk.pk.broken.N if it exists,
+// auto increment file is created if missing.
+// restore puts old pk file back and removes created files, such as rebuilding fails.
+func ResetPkFiles(directory string, auto bool) (restore func() error, e error) {
+	if e = os.MkdirAll(directory, os.ModePerm); e != nil {
+		return
+	}
+	pkFile := path.Join(directory, "pk.pk")
+	var broken string
+	if com.IsFile(pkFile) {
+		broken = pkFile + ".broken"
+		for i := 1; com.IsFile(broken); i++ {
+			broken = pkFile + ".broken." + strconv.Itoa(i)
+		}
+		if e = os.Rename(pkFile, broken); e != nil {
+			return
+		}
+	}
+	autoFile := path.Join(directory, "auto.pk")
+	createAuto := auto && !com.IsFile(autoFile)
+	restore = func() error {
+		if createAuto {
+			if e := os.RemoveAll(autoFile); e != nil {
+				return e
+			}
+		}
+		if broken == "" {
+			return os.RemoveAll(pkFile)
+		}
+		return os.Rename(broken, pkFile)
+	}
+	defer func() {
+		if e != nil {
+			restore()
+			restore = nil
+		}
+	}()
+	// optimized pk file must not replace empty pk file
+	if e = os.RemoveAll(pkFile + ".opm"); e != nil {
+		return
+	}
+	if e = ioutil.WriteFile(pkFile, nil, os.ModePerm); e != nil {
+		return
+	}
+	if createAuto {
+		e = writeFileAtomic(autoFile, int64ToBytes(0))
+	}
+	return
+}
 
+// migrate pk file with legacy string keys.
+// memory pk data with typed keys replace pk file.
+func (p *PK) migrate() (e error) {
+	values := make([]*PkValue, 0, len(p.data))
+	for _, pkValue := range p.data {
+		values = append(values, pkValue)
+	}
+	e = p.replaceFile(values)
+	return
+}
+
+// replace pk file by values.
+// values are written to temp file and synced, then it's renamed to pk file and reopened,
+// so it never leaves half pk file. optimized file is out of date and removed.
+func (p *PK) replaceFile(values []*PkValue) (e error) {
+	pkFile := path.Join(p.directory, "pk.pk")
+	tmpFile := pkFile + ".tmp"
+	fileWriter, e := os.OpenFile(tmpFile, os.O_CREATE|os.O_TRUNC|os.O_RDWR, os.ModePerm)
+	if e != nil {
+		return
+	}
+	w := bufio.NewWriter(fileWriter)
+	for _, pkValue := range values {
+		bytes, e := json.Marshal(pkValue)
+		if e != nil {
+			fileWriter.Close()
+			return e
+		}
+		w.Write(int64ToBytes(int64(len(bytes))))
+		w.Write(bytes)
+	}
+	if e = w.Flush(); e != nil {
+		fileWriter.Close()
+		return
+	}
+	if e = fileWriter.Sync(); e != nil {
+		fileWriter.Close()
+		return
+	}
+	if e = fileWriter.Close(); e != nil {
+		return
+	}
+
+	p.file.Close()
+	if e = os.Rename(tmpFile, pkFile); e != nil {
+		return
+	}
+	if e = os.RemoveAll(pkFile + ".opm"); e != nil {
+		return
+	}
+	if p.file, e = os.OpenFile(pkFile, os.O_APPEND|os.O_RDWR, os.ModePerm); e == nil {
+		p.legacy = false
+	}
 	return
 }
 
 func (p *PK) tryOptimized() (e error) {
+	// temp files of canceled optimizing are useless
+	if e = removeFiles(filepath.Join(p.directory, "*.opm.tmp")); e != nil {
+		return
+	}
 	files, e := filepath.Glob(filepath.Join(p.directory, "*.opm"))
 	if e != nil {
 		return
@@ -292,42 +746,77 @@ func (p *PK) tryOptimized() (e error) {
 // optimize pk value to opm file.
 // clean delete items.
 func (p *PK) Optimize() (e error) {
-	optFile := path.Join(p.directory, "pk.pk.opm")
+	return p.OptimizeContext(context.Background())
+}
 
-	fileWriter, e := os.OpenFile(optFile, os.O_CREATE|os.O_TRUNC|os.O_RDWR, os.ModePerm)
-	if e != nil {
-		return
-	}
+// optimize pk value to opm file until ctx is canceled.
+// opm file is written by temp file and renamed, so canceling leaves no half written opm file.
+func (p *PK) OptimizeContext(ctx context.Context) (e error) {
+	optFile := path.Join(p.directory, "pk.pk.opm")
 
 	// pull all memory pk data to opm file.
-	for _, pkValue := range p.data {
-		bytes, e := json.Marshal(pkValue)
-		if e != nil {
-			return e
-		}
-		if e = p.writeBytes(bytes, fileWriter); e != nil {
-			return e
+	e = writeOptimized(ctx, optFile, func(f *os.File) error {
+		w := bufio.NewWriter(f)
+		for _, pkValue := range p.data {
+			if e := ctx.Err(); e != nil {
+				return e
+			}
+			b, e := json.Marshal(pkValue)
+			if e != nil {
+				return e
+			}
+			w.Write(int64ToBytes(int64(len(b))))
+			if _, e = w.Write(b); e != nil {
+				return e
+			}
 		}
-	}
+		return w.Flush()
+	})
+	return
+}
 
+// create new pk in directory with pk auto-increment setting,
+// and pk field types to read legacy string keys.
+func NewPk(directory string, auto bool, types []reflect.Type) (p *PK, e error) {
+	p = &PK{
+		directory: directory,
+		auto:      auto,
+		types:     types,
+		data:      make(map[string]*PkValue),
+	}
+	e = p.init()
 	return
 }
 
-// create new pk in directory with pk auto-increment setting.
-func NewPk(directory string, auto bool) (p *PK, e error) {
+// create read-only pk to read pk values without changing files,
+// such as reading directory opened by running program.
+// pk values can't be written to read-only pk.
+func NewReadOnlyPk(directory string, auto bool, types []reflect.Type) (p *PK, e error) {
 	p = &PK{
 		directory: directory,
 		auto:      auto,
+		types:     types,
 		data:      make(map[string]*PkValue),
+		readOnly:  true,
 	}
 	e = p.init()
 	return
 }
 
 // PkValue defines the each pk item data struct.
+// Key is typed key bytes by EncodeKey.
+// Value is legacy string key, only read to migrate old pk file.
+// Exp is expiration time in unix nanoseconds, 0 is never expired.
 type PkValue struct {
-	Value  string `json:"v"`
+	Key    []byte `json:"k,omitempty"`
+	Value  string `json:"v,omitempty"`
 	Uid    int64  `json:"u,omitempty"`
 	Cursor int    `json:"c,omitempty"`
 	Del    int    `json:"d"`
+	Exp    int64  `json:"e,omitempty"`
+}
+
+// is expired at now unix nanoseconds.
+func (v *PkValue) Expired(now int64) bool {
+	return v.Exp > 0 && v.Exp <= now
 }
@@ -0,0 +1,96 @@
+package col
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// name of quarantine directory, next to chunk directory.
+const QuarantineDir = "_quarantine"
+
+// name of quarantine report file, one json line for each quarantine.
+const quarantineReport = "report.jsonl"
+
+// Quarantine is broken frame skipped by tolerant loading.
+// its bytes are copied to Path in quarantine directory.
+// truncated frame runs to file end, the chunk file is truncated at its offset,
+// so new frames are appended after good frames, except read-only chunk.
+type Quarantine struct {
+	File      string    `json:"file"`
+	Offset    int64     `json:"offset"`
+	Size      int64     `json:"size"`
+	Truncated bool      `json:"truncated,omitempty"`
+	Reason    string    `json:"reason"`
+	Path      string    `json:"path"`
+	Time      time.Time `json:"time"`
+}
+
+// set tolerant loading.
+// broken frames are skipped and quarantined, instead of failing to read chunk file.
+// fn is called for each quarantined frame, it can be nil.
+func (c *Chunk) SetTolerant(fn func(q *Quarantine)) {
+	c.tolerant = true
+	c.onQuarantine = fn
+}
+
+// get quarantined frames since chunk is opened.
+func (c *Chunk) Quarantined() []*Quarantine {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	return append([]*Quarantine(nil), c.quarantined...)
+}
+
+// copy broken frame bytes to quarantine directory and write report.
+// same frame loaded again is not copied and reported twice.
+// read-only chunk only keeps it in memory, Path is empty.
+func (c *Chunk) quarantine(fe *FrameError, b []byte) (e error) {
+	for _, q := range c.quarantined {
+		if q.File == fe.File && q.Offset == fe.Offset {
+			return
+		}
+	}
+	dir := filepath.Join(filepath.Dir(c.directory), QuarantineDir)
+	q := &Quarantine{
+		File:      fe.File,
+		Offset:    fe.Offset,
+		Size:      fe.Size,
+		Truncated: fe.Truncated,
+		Reason:    fe.Reason,
+		Path:      filepath.Join(dir, fmt.Sprintf("%s.%d.bad", filepath.Base(fe.File), fe.Offset)),
+		Time:      time.Now(),
+	}
+	if c.readOnly {
+		q.Path = ""
+	} else if _, err := os.Stat(q.Path); os.IsNotExist(err) {
+		if e = os.MkdirAll(dir, os.ModePerm); e != nil {
+			return
+		}
+		if e = ioutil.WriteFile(q.Path, b, os.ModePerm); e != nil {
+			return
+		}
+		line, e := json.Marshal(q)
+		if e != nil {
+			return e
+		}
+		f, e := os.OpenFile(filepath.Join(dir, quarantineReport), os.O_CREATE|os.O_APPEND|os.O_WRONLY, os.ModePerm)
+		if e != nil {
+			return e
+		}
+		_, e = f.Write(append(line, '\n'))
+		if ce := f.Close(); e == nil {
+			e = ce
+		}
+		if e != nil {
+			return e
+		}
+	}
+	c.quarantined = append(c.quarantined, q)
+	if c.onQuarantine != nil {
+		c.onQuarantine(q)
+	}
+	return
+}
@@ -0,0 +1,79 @@
+package col
+
+import (
+	"sort"
+)
+
+// ChunkStats is stats of one chunk file.
+// live bytes are frames pointed by pk values, others are dead bytes,
+// such as old values of updated or deleted values and delete marks, cleaned by optimizing.
+// memory is json size of values loaded in memory, approximately.
+type ChunkStats struct {
+	File      string `json:"file"`
+	Cursor    int    `json:"cursor"`
+	Bytes     int64  `json:"bytes"`
+	Frames    int    `json:"frames"`
+	LiveBytes int64  `json:"live_bytes"`
+	DeadBytes int64  `json:"dead_bytes"`
+	Loaded    bool   `json:"loaded"`
+	Values    int    `json:"values"`
+	Memory    int64  `json:"memory"`
+}
+
+// get stats of all chunk files in cursor order.
+// it walks all frames from disk, values pointed by pks are live.
+func (c *Chunk) Stats(pks []*PkValue) (stats []*ChunkStats, e error) {
+	live := make(map[int]map[int64]bool)
+	for _, pk := range pks {
+		if live[pk.Cursor] == nil {
+			live[pk.Cursor] = make(map[int64]bool)
+		}
+		live[pk.Cursor][pk.Uid] = true
+	}
+
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	files, e := c.Files()
+	if e != nil {
+		return
+	}
+	byCursor := make(map[int]*ChunkStats)
+	_, e = c.WalkFrames(func(f *Frame) error {
+		s := byCursor[f.Cursor]
+		if s == nil {
+			data, loaded := c.data[f.Cursor]
+			s = &ChunkStats{File: f.File, Cursor: f.Cursor, Bytes: files[f.File], Loaded: loaded, Values: len(data)}
+			byCursor[f.Cursor] = s
+			stats = append(stats, s)
+		}
+		s.Frames++
+		if !f.Deleted && live[f.Cursor][f.Uid] {
+			s.LiveBytes += int64(16 + len(f.Data))
+		}
+		if _, ok := c.data[f.Cursor][f.Uid]; ok && !f.Deleted {
+			s.Memory += int64(len(f.Data))
+		}
+		return nil
+	})
+	if e != nil {
+		return nil, e
+	}
+	// empty files have no frame
+	for file, size := range files {
+		cursor, ok := c.cursorOf(file)
+		if !ok || byCursor[cursor] != nil {
+			continue
+		}
+		data, loaded := c.data[cursor]
+		s := &ChunkStats{File: file, Cursor: cursor, Bytes: size, Loaded: loaded, Values: len(data)}
+		byCursor[cursor] = s
+		stats = append(stats, s)
+	}
+	for _, s := range stats {
+		s.DeadBytes = s.Bytes - s.LiveBytes
+	}
+	sort.Slice(stats, func(i, j int) bool {
+		return stats[i].Cursor < stats[j].Cursor
+	})
+	return
+}
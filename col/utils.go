@@ -1,6 +1,11 @@
 package col
 
-import "encoding/binary"
+import (
+	"context"
+	"encoding/binary"
+	"os"
+	"path/filepath"
+)
 
 func int64ToBytes(i int64) []byte {
 	var buf = make([]byte, 8)
@@ -11,3 +16,77 @@ func int64ToBytes(i int64) []byte {
 func bytesToInt64(buf []byte) int64 {
 	return int64(binary.BigEndian.Uint64(buf))
 }
+
+// write file by temp file and rename,
+// so the file is old or new, never half written.
+func writeFileAtomic(file string, b []byte) (e error) {
+	tmpFile := file + ".tmp"
+	f, e := os.OpenFile(tmpFile, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, os.ModePerm)
+	if e != nil {
+		return
+	}
+	if _, e = f.Write(b); e != nil {
+		f.Close()
+		return
+	}
+	if e = f.Sync(); e != nil {
+		f.Close()
+		return
+	}
+	if e = f.Close(); e != nil {
+		return
+	}
+	e = os.Rename(tmpFile, file)
+	return
+}
+
+// write optimized file by temp file and rename.
+// temp file is removed if fn fails or ctx is canceled,
+// so optimized file is complete or missing, never half written.
+func writeOptimized(ctx context.Context, file string, fn func(f *os.File) error) (e error) {
+	tmpFile := file + ".tmp"
+	f, e := os.OpenFile(tmpFile, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, os.ModePerm)
+	if e != nil {
+		return
+	}
+	if e = fn(f); e == nil {
+		e = ctx.Err()
+	}
+	if e == nil {
+		e = f.Sync()
+	}
+	if ce := f.Close(); e == nil {
+		e = ce
+	}
+	if e != nil {
+		os.Remove(tmpFile)
+		return
+	}
+	e = os.Rename(tmpFile, file)
+	return
+}
+
+// remove files matching pattern.
+func removeFiles(pattern string) (e error) {
+	files, e := filepath.Glob(pattern)
+	if e != nil {
+		return
+	}
+	for _, f := range files {
+		if e = os.Remove(f); e != nil {
+			return
+		}
+	}
+	return
+}
+
+// get file to read in read-only loading.
+// optimized file is read if it's newer, as it replaces the file when opening to write.
+func readableFile(file string) string {
+	fi, _ := os.Stat(file + ".opm")
+	ofi, _ := os.Stat(file)
+	if fi != nil && ofi != nil && fi.ModTime().Sub(ofi.ModTime()) > 1 {
+		return file + ".opm"
+	}
+	return file
+}
@@ -0,0 +1,165 @@
+package jx
+
+import (
+	"context"
+	"fmt"
+	"reflect"
+)
+
+// TypedCollection is typed api of synced struct T, pk type is K.
+// table is resolved once when creating collection, not in each call.
+// values are read into T, so no half filled struct is needed to get or delete by pk.
+type TypedCollection[T any, K any] struct {
+	table *Table
+
+	// pk of interface type K is converted to pk field types.
+	convert bool
+}
+
+// get collection of synced struct T with pk type K.
+// K is same type as pk field, such as int64 of auto increment pk,
+// so pk is checked at compile time. composite pk needs K as interface{}.
+// it's the main entry of typed api.
+func CollectionOf[T any, K any](s *Storage) (c *TypedCollection[T, K], e error) {
+	rt := reflect.TypeOf((*T)(nil)).Elem()
+	tbl := s.tables[rt]
+	if tbl == nil {
+		e = notSynced(rt)
+		return
+	}
+	kt := reflect.TypeOf((*K)(nil)).Elem()
+	if kt.Kind() != reflect.Interface && (tbl.Object.IsComposite() || kt != tbl.Object.PkTypes[0]) {
+		e = fmt.Errorf("collection pk need %s : %s", pkTypeName(tbl.Object), rt.String())
+		return
+	}
+	c = &TypedCollection[T, K]{table: tbl, convert: kt.Kind() == reflect.Interface}
+	return
+}
+
+// get collection of synced struct T, pk is interface{}, such as composite pk.
+// pk is checked at runtime, numbers are converted to pk field type if exact,
+// so untyped int constant is int64 pk, other values need same type as pk field.
+// composite pk needs []interface{} of all pk fields.
+func Collection[T any](s *Storage) (*TypedCollection[T, interface{}], error) {
+	return CollectionOf[T, interface{}](s)
+}
+
+// name of pk type for collection.
+func pkTypeName(o *Object) string {
+	if o.IsComposite() {
+		return "interface{}"
+	}
+	return o.PkTypes[0].String()
+}
+
+// set pk fields of v.
+// pk of interface type K is converted, otherwise it's same type as pk field.
+func (c *TypedCollection[T, K]) setPk(v *T, pk K) (e error) {
+	var value interface{} = pk
+	if c.convert {
+		if value, e = c.table.Object.ConvertPk(value); e != nil {
+			return
+		}
+	}
+	return c.table.Object.setPk(v, value)
+}
+
+// get table of collection.
+func (c *TypedCollection[T, K]) Table() *Table {
+	return c.table
+}
+
+// get value by pk.
+// if not found, return error Nil.
+func (c *TypedCollection[T, K]) Get(pk K) (v T, e error) {
+	if e = c.setPk(&v, pk); e != nil {
+		return
+	}
+	e = c.table.Get(&v)
+	return
+}
+
+// insert value, pk-auto or generated pk is set to v.
+func (c *TypedCollection[T, K]) Insert(v *T) error {
+	return c.table.Insert(v)
+}
+
+// insert or update value by pk.
+func (c *TypedCollection[T, K]) Put(v *T) error {
+	return c.table.Put(v)
+}
+
+// update value by pk.
+// if not found, return error Nil.
+func (c *TypedCollection[T, K]) Update(v *T) error {
+	return c.table.Update(v)
+}
+
+// modify value by pk atomically, and return modified value.
+// if fn returns error, nothing is saved.
+func (c *TypedCollection[T, K]) Modify(pk K, fn func(v *T) error) (v T, e error) {
+	// check pk type as Get
+	if e = c.setPk(&v, pk); e != nil {
+		return
+	}
+	e = c.table.Modify(&v, pk, func(value interface{}) error {
+		return fn(value.(*T))
+	})
+	return
+}
+
+// delete value by pk, without version check.
+// if not found, return error Nil.
+func (c *TypedCollection[T, K]) Delete(pk K) (e error) {
+	var v T
+	if e = c.setPk(&v, pk); e != nil {
+		return
+	}
+	e = c.table.Delete(&v)
+	return
+}
+
+// find values matched by fn in pk order.
+// nil fn matches all values, prefix values match the leading fields of composite pk.
+func (c *TypedCollection[T, K]) Find(fn func(v *T) bool, prefix ...interface{}) (values []T, e error) {
+	e = c.Scan(func(v *T) bool {
+		if fn == nil || fn(v) {
+			values = append(values, *v)
+		}
+		return true
+	}, prefix...)
+	return
+}
+
+// scan values in pk order.
+// fn gets a copy of each value, returns false to stop scanning.
+func (c *TypedCollection[T, K]) Scan(fn func(v *T) bool, prefix ...interface{}) error {
+	return c.ScanContext(context.Background(), fn, prefix...)
+}
+
+// scan values in pk order until ctx is canceled.
+func (c *TypedCollection[T, K]) ScanContext(ctx context.Context, fn func(v *T) bool, prefix ...interface{}) error {
+	return c.table.ScanContext(ctx, func(v interface{}) bool {
+		return fn(v.(*T))
+	}, prefix...)
+}
+
+// iterate values in pk order, it's iter.Seq2[T, error] of Go 1.23:
+//
+//	for u, e := range users.All() {
+//	}
+//
+// error of reading values is yielded last, then iterating stops.
+func (c *TypedCollection[T, K]) All(prefix ...interface{}) func(yield func(T, error) bool) {
+	return func(yield func(T, error) bool) {
+		stopped := false
+		e := c.Scan(func(v *T) bool {
+			stopped = !yield(*v, nil)
+			return !stopped
+		}, prefix...)
+		if e != nil && !stopped {
+			var zero T
+			yield(zero, e)
+		}
+	}
+}
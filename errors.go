@@ -0,0 +1,108 @@
+package jx
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/fuxiaohei/jx/col"
+	"reflect"
+	"strings"
+)
+
+var (
+	// ErrNotFound is same as Nil, value is not found by pk.
+	ErrNotFound = Nil
+	// ErrConflict is same as Conflict, pk is used.
+	ErrConflict = Conflict
+	// ErrNotSynced means struct is not synced to storage.
+	ErrNotSynced = errors.New("not synced")
+	// ErrCorrupt means data file is broken.
+	ErrCorrupt = errors.New("corrupt")
+	// ErrClosed means table is closed.
+	ErrClosed = errors.New("closed")
+)
+
+// Error is storage error with table, pk and file path.
+// Kind is Wrong, ErrNotSynced, ErrCorrupt or ErrClosed,
+// errors.Is(e, Kind) is true, and Err is underlying error, such as broken frame.
+// Nil, Conflict and ErrStaleVersion are returned as they are, so they can be compared by ==.
+// use errors.As to get Error from returned error.
+type Error struct {
+	Kind  error
+	Table string
+	Pk    interface{}
+	Path  string
+	Err   error
+}
+
+// error message with kind, table, pk, path and underlying error.
+func (e *Error) Error() string {
+	s := []string{kindName(e.Kind)}
+	if e.Table != "" {
+		s = append(s, e.Table)
+	}
+	if e.Pk != nil {
+		s = append(s, fmt.Sprintf("pk %v", e.Pk))
+	}
+	if e.Path != "" {
+		s = append(s, e.Path)
+	}
+	if e.Err != nil {
+		s = append(s, e.Err.Error())
+	}
+	return strings.Join(s, " : ")
+}
+
+// underlying error.
+func (e *Error) Unwrap() error {
+	return e.Err
+}
+
+// match error kind.
+func (e *Error) Is(target error) bool {
+	return target == e.Kind
+}
+
+// name of error kind.
+func kindName(kind error) string {
+	switch kind {
+	case Nil:
+		return "not found"
+	case Conflict:
+		return "conflict"
+	}
+	return kind.Error()
+}
+
+// error of not synced struct type.
+func notSynced(rt reflect.Type) error {
+	return &Error{Kind: ErrNotSynced, Table: rt.String()}
+}
+
+// error of table with kind, pk and underlying error.
+// pk of single field is not wrapped by slice.
+func (t *Table) error(kind error, pk interface{}, err error) error {
+	if fields, ok := pk.([]interface{}); ok && len(fields) == 1 {
+		pk = fields[0]
+	}
+	return &Error{Kind: kind, Table: t.Object.DataType.String(), Pk: pk, Err: err}
+}
+
+// error of broken file in table.
+// errors not caused by broken data are returned as they are.
+func (t *Table) corrupt(pk interface{}, path string, err error) error {
+	if !isCorrupt(err) {
+		return err
+	}
+	e := t.error(ErrCorrupt, pk, err).(*Error)
+	e.Path = path
+	return e
+}
+
+// error is caused by broken data, such as broken frame or bad json.
+func isCorrupt(err error) bool {
+	var fe *col.FrameError
+	var se *json.SyntaxError
+	var te *json.UnmarshalTypeError
+	return errors.As(err, &fe) || errors.As(err, &se) || errors.As(err, &te) || errors.Is(err, col.ErrFileMissing)
+}
@@ -0,0 +1,116 @@
+package jx
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"reflect"
+	"time"
+)
+
+// ConflictPolicy decides what to do when imported value pk is found in table.
+type ConflictPolicy int
+
+const (
+	// stop importing and return Conflict.
+	ConflictFail ConflictPolicy = iota
+	// keep saved value and skip imported value.
+	ConflictSkip
+	// replace saved value by imported value.
+	ConflictOverwrite
+)
+
+// ImportOptions sets importing behaviors.
+type ImportOptions struct {
+	Conflict ConflictPolicy
+}
+
+// export live values to writer as json lines, in pk order.
+func (t *Table) Export(w io.Writer) (e error) {
+	enc := json.NewEncoder(w)
+	var we error
+	e = t.Scan(func(v interface{}) bool {
+		we = enc.Encode(v)
+		return we == nil
+	})
+	if e == nil {
+		e = we
+	}
+	return
+}
+
+// import values from json lines reader.
+// explicit auto-increment pk is kept, and auto increment id is advanced past it.
+// empty auto-increment or generated pk gets new pk.
+// it returns count of inserted or overwritten values.
+func (t *Table) Import(r io.Reader, opts ImportOptions) (n int, e error) {
+	return t.ImportContext(context.Background(), r, opts)
+}
+
+// import values from json lines reader until ctx is canceled.
+// values imported before canceling are kept, and their count is returned with ctx error.
+func (t *Table) ImportContext(ctx context.Context, r io.Reader, opts ImportOptions) (n int, e error) {
+	dec := json.NewDecoder(r)
+	for i := 1; ; i++ {
+		if e = ctx.Err(); e != nil {
+			return
+		}
+		v := reflect.New(t.Object.DataType).Interface()
+		if e = dec.Decode(v); e != nil {
+			if e == io.EOF {
+				e = nil
+			} else {
+				e = fmt.Errorf("import value %d : %s", i, e.Error())
+			}
+			return
+		}
+		ok, e := t.importValue(v, opts.Conflict)
+		if e != nil {
+			return n, e
+		}
+		if ok {
+			n++
+		}
+	}
+}
+
+// import one value with conflict policy.
+// it returns false if value is skipped.
+func (t *Table) importValue(v interface{}, policy ConflictPolicy) (ok bool, e error) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	if e = t.checkClosed(); e != nil {
+		return
+	}
+
+	pk := t.Object.PkValue(v)
+	if reflect.ValueOf(v).Elem().FieldByName(t.Object.Pk).IsZero() && (t.Object.PkAuto || t.Object.PkGen != "") {
+		return true, t.insert(v, true)
+	}
+	pkValue, e := t.getPk(pk)
+	if e != nil {
+		e = t.pkError(pk, e)
+		return
+	}
+	if pkValue == nil {
+		return true, t.insert(v, true)
+	}
+	switch policy {
+	case ConflictSkip:
+		return false, nil
+	case ConflictOverwrite:
+		saved, e := t.value(pkValue)
+		if e != nil {
+			return false, e
+		}
+		if e = beforeUpdate(v); e != nil {
+			return false, e
+		}
+		// overwrite no matter saved version, imported version and time fields are kept
+		now := time.Now()
+		t.prepareImport(v, now)
+		return true, t.replace(pk, pkValue, v, saved, now)
+	}
+	return false, Conflict
+}
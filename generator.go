@@ -0,0 +1,190 @@
+package jx
+
+import (
+	"crypto/rand"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"reflect"
+	"sync"
+	"time"
+)
+
+// Generator generates new pk value when inserting value with empty pk.
+// the pk value should be unique across storages.
+type Generator interface {
+	Generate() (interface{}, error)
+}
+
+// GeneratorFunc is a func as Generator.
+type GeneratorFunc func() (interface{}, error)
+
+// generate pk value by calling func.
+func (f GeneratorFunc) Generate() (interface{}, error) {
+	return f()
+}
+
+// UUID is random uuid version 4.
+type UUID [16]byte
+
+// create new random uuid.
+func NewUUID() (u UUID, e error) {
+	if _, e = rand.Read(u[:]); e != nil {
+		return
+	}
+	u[6] = u[6]&0x0f | 0x40
+	u[8] = u[8]&0x3f | 0x80
+	return
+}
+
+// uuid string in canonical format.
+func (u UUID) String() string {
+	b := make([]byte, 36)
+	hex.Encode(b[0:8], u[0:4])
+	hex.Encode(b[9:13], u[4:6])
+	hex.Encode(b[14:18], u[6:8])
+	hex.Encode(b[19:23], u[8:10])
+	hex.Encode(b[24:], u[10:])
+	b[8], b[13], b[18], b[23] = '-', '-', '-', '-'
+	return string(b)
+}
+
+// ULID is lexicographically sortable id,
+// 48 bits milliseconds time and 80 bits randomness.
+type ULID [16]byte
+
+const ulidEncoding = "0123456789ABCDEFGHJKMNPQRSTVWXYZ"
+
+// ulid string in crockford base32 format.
+func (u ULID) String() string {
+	b := make([]byte, 26)
+	// 128 bits to 26 chars, 5 bits per char from the tail.
+	hi, lo := binary.BigEndian.Uint64(u[:8]), binary.BigEndian.Uint64(u[8:])
+	for i := 25; i >= 0; i-- {
+		b[i] = ulidEncoding[lo&0x1f]
+		lo = lo>>5 | hi<<59
+		hi >>= 5
+	}
+	return string(b)
+}
+
+// ulid generator.
+// ulids in same millisecond are increasing by randomness part.
+type ulidGenerator struct {
+	lock sync.Mutex
+	last ULID
+}
+
+// generate new ulid.
+func (g *ulidGenerator) Generate() (v interface{}, e error) {
+	g.lock.Lock()
+	defer g.lock.Unlock()
+
+	var u ULID
+	ms := uint64(time.Now().UnixNano() / int64(time.Millisecond))
+	u[0], u[1], u[2], u[3], u[4], u[5] = byte(ms>>40), byte(ms>>32), byte(ms>>24), byte(ms>>16), byte(ms>>8), byte(ms)
+	if string(u[:6]) != string(g.last[:6]) {
+		if _, e = rand.Read(u[6:]); e != nil {
+			return
+		}
+	} else {
+		// same millisecond, increase last randomness
+		u = g.last
+		for i := 15; i >= 6; i-- {
+			u[i]++
+			if u[i] != 0 {
+				break
+			}
+			if i == 6 {
+				e = fmt.Errorf("ulid randomness overflow")
+				return
+			}
+		}
+	}
+	g.last = u
+	v = u
+	return
+}
+
+// Snowflake generates int64 ids by
+// 41 bits milliseconds time, 10 bits node and 12 bits sequence.
+// ids are unique across storages with different nodes.
+type Snowflake struct {
+	lock     sync.Mutex
+	node     int64
+	lastMs   int64
+	sequence int64
+}
+
+// snowflake epoch, 2020-01-01 UTC in milliseconds.
+const snowflakeEpoch int64 = 1577836800000
+
+// create snowflake generator by node id in 0 to 1023.
+func NewSnowflake(node int64) (s *Snowflake, e error) {
+	if node < 0 || node > 1023 {
+		e = fmt.Errorf("snowflake node need 0 to 1023 : %d", node)
+		return
+	}
+	s = &Snowflake{node: node}
+	return
+}
+
+// generate new snowflake id.
+// it waits next millisecond if sequence is used up.
+func (s *Snowflake) Generate() (interface{}, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	ms := time.Now().UnixNano() / int64(time.Millisecond)
+	if ms < s.lastMs {
+		// clock moves backwards, keep last time
+		ms = s.lastMs
+	}
+	if ms == s.lastMs {
+		s.sequence = (s.sequence + 1) & 0xfff
+		if s.sequence == 0 {
+			for ms <= s.lastMs {
+				time.Sleep(100 * time.Microsecond)
+				ms = time.Now().UnixNano() / int64(time.Millisecond)
+			}
+		}
+	} else {
+		s.sequence = 0
+	}
+	s.lastMs = ms
+	return (ms-snowflakeEpoch)<<22 | s.node<<12 | s.sequence, nil
+}
+
+// default generators in storage.
+func defaultGenerators() map[string]Generator {
+	return map[string]Generator{
+		"uuid": GeneratorFunc(func() (interface{}, error) {
+			return NewUUID()
+		}),
+		"ulid": new(ulidGenerator),
+	}
+}
+
+// set generated value to pk field.
+// the value is converted to field type,
+// or formatted by String() if field is string.
+func setGenerated(field reflect.Value, v interface{}) (e error) {
+	rv := reflect.ValueOf(v)
+	if !rv.IsValid() {
+		return fmt.Errorf("generated pk is nil")
+	}
+	if field.Kind() == reflect.String {
+		if rv.Kind() == reflect.String {
+			field.SetString(rv.String())
+			return
+		}
+		if s, ok := v.(fmt.Stringer); ok {
+			field.SetString(s.String())
+			return
+		}
+	} else if rv.Type().ConvertibleTo(field.Type()) {
+		field.Set(rv.Convert(field.Type()))
+		return
+	}
+	return fmt.Errorf("generated pk %s can't set to %s", rv.Type().String(), field.Type().String())
+}
@@ -0,0 +1,91 @@
+package jx
+
+// BeforeInserter is called before inserting value.
+// returning error aborts inserting.
+type BeforeInserter interface {
+	BeforeInsert() error
+}
+
+// AfterInserter is called after value is inserted.
+type AfterInserter interface {
+	AfterInsert()
+}
+
+// BeforeUpdater is called before updating value.
+// returning error aborts updating.
+type BeforeUpdater interface {
+	BeforeUpdate() error
+}
+
+// AfterUpdater is called after value is updated.
+type AfterUpdater interface {
+	AfterUpdate()
+}
+
+// BeforeDeleter is called before deleting value.
+// returning error aborts deleting.
+type BeforeDeleter interface {
+	BeforeDelete() error
+}
+
+// AfterDeleter is called after value is deleted.
+type AfterDeleter interface {
+	AfterDelete()
+}
+
+// AfterLoader is called after value is loaded by getting or scanning.
+type AfterLoader interface {
+	AfterLoad()
+}
+
+// call BeforeInsert hook if value has.
+func beforeInsert(v interface{}) error {
+	if h, ok := v.(BeforeInserter); ok {
+		return h.BeforeInsert()
+	}
+	return nil
+}
+
+// call AfterInsert hook if value has.
+func afterInsert(v interface{}) {
+	if h, ok := v.(AfterInserter); ok {
+		h.AfterInsert()
+	}
+}
+
+// call BeforeUpdate hook if value has.
+func beforeUpdate(v interface{}) error {
+	if h, ok := v.(BeforeUpdater); ok {
+		return h.BeforeUpdate()
+	}
+	return nil
+}
+
+// call AfterUpdate hook if value has.
+func afterUpdate(v interface{}) {
+	if h, ok := v.(AfterUpdater); ok {
+		h.AfterUpdate()
+	}
+}
+
+// call BeforeDelete hook if value has.
+func beforeDelete(v interface{}) error {
+	if h, ok := v.(BeforeDeleter); ok {
+		return h.BeforeDelete()
+	}
+	return nil
+}
+
+// call AfterDelete hook if value has.
+func afterDelete(v interface{}) {
+	if h, ok := v.(AfterDeleter); ok {
+		h.AfterDelete()
+	}
+}
+
+// call AfterLoad hook if value has.
+func afterLoad(v interface{}) {
+	if h, ok := v.(AfterLoader); ok {
+		h.AfterLoad()
+	}
+}
@@ -0,0 +1,113 @@
+package jx
+
+import (
+	"errors"
+	"expvar"
+	"github.com/fuxiaohei/jx/col"
+	"time"
+)
+
+// Logger logs storage events, such as chunk loading and errors.
+// *log.Logger is a Logger.
+type Logger interface {
+	Printf(format string, v ...interface{})
+}
+
+// Metrics receives operation latencies and chunk events of tables.
+// methods are called synchronously, they should be fast.
+type Metrics interface {
+	// operation is done, such as insert, get, update, delete, scan and optimize.
+	// error is not nil if operation failed.
+	Operation(table, op string, d time.Duration, e error)
+	// chunk file is loaded to memory.
+	ChunkLoaded(table string, cursor int, values int, d time.Duration)
+	// chunk file is compacted by optimizing.
+	ChunkCompacted(table string, cursor int)
+	// current chunk file is full, values are written to new cursor file.
+	ChunkRollover(table string, cursor int)
+}
+
+// observe operation latency and error, by deferred calling with start time and pointer of returned error.
+// error Nil is not failure, it's not logged.
+func (t *Table) observe(op string, start time.Time, e *error) {
+	if t.options.Metrics != nil {
+		t.options.Metrics.Operation(t.Object.DataType.String(), op, time.Since(start), *e)
+	}
+	if *e != nil && !errors.Is(*e, Nil) {
+		t.logf("%s %s failed : %v", t.Object.DataType.String(), op, *e)
+	}
+}
+
+// log by options logger.
+func (t *Table) logf(format string, v ...interface{}) {
+	if t.options.Logger != nil {
+		t.options.Logger.Printf(format, v...)
+	}
+}
+
+// set chunk hooks to log and measure chunk events.
+func (t *Table) setChunkHooks() {
+	name := t.Object.DataType.String()
+	m := t.options.Metrics
+	t.Chunk.SetHooks(col.ChunkHooks{
+		Load: func(cursor int, values int, d time.Duration) {
+			t.logf("%s load chunk %d, %d values in %v", name, cursor, values, d)
+			if m != nil {
+				m.ChunkLoaded(name, cursor, values, d)
+			}
+		},
+		Compact: func(cursor int) {
+			t.logf("%s compact chunk %d", name, cursor)
+			if m != nil {
+				m.ChunkCompacted(name, cursor)
+			}
+		},
+		Rollover: func(cursor int) {
+			t.logf("%s rollover to chunk %d", name, cursor)
+			if m != nil {
+				m.ChunkRollover(name, cursor)
+			}
+		},
+	})
+}
+
+// ExpvarMetrics publishes metrics as expvar map.
+// keys are table and op joined by dot, such as "main.User.get.count":
+//
+//	<table>.<op>.count    operation count
+//	<table>.<op>.errors   failed operation count, error Nil is not counted
+//	<table>.<op>.nanos    total operation nanoseconds
+//	<table>.chunk.loads, <table>.chunk.compactions, <table>.chunk.rollovers
+type ExpvarMetrics struct {
+	Map *expvar.Map
+}
+
+// create expvar metrics published by name.
+// it panics if name is already published, as expvar.Publish.
+func NewExpvarMetrics(name string) *ExpvarMetrics {
+	return &ExpvarMetrics{Map: expvar.NewMap(name)}
+}
+
+// add operation count, errors and nanoseconds.
+func (m *ExpvarMetrics) Operation(table, op string, d time.Duration, e error) {
+	m.Map.Add(table+"."+op+".count", 1)
+	if e != nil && !errors.Is(e, Nil) {
+		m.Map.Add(table+"."+op+".errors", 1)
+	}
+	m.Map.Add(table+"."+op+".nanos", int64(d))
+}
+
+// add chunk loads count.
+func (m *ExpvarMetrics) ChunkLoaded(table string, cursor int, values int, d time.Duration) {
+	m.Map.Add(table+".chunk.loads", 1)
+}
+
+// add chunk compactions count.
+func (m *ExpvarMetrics) ChunkCompacted(table string, cursor int) {
+	m.Map.Add(table+".chunk.compactions", 1)
+}
+
+// add chunk rollovers count.
+func (m *ExpvarMetrics) ChunkRollover(table string, cursor int) {
+	m.Map.Add(table+".chunk.rollovers", 1)
+}
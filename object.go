@@ -3,6 +3,7 @@ package jx
 import (
 	"fmt"
 	"reflect"
+	"strings"
 )
 
 type Object struct {
@@ -12,13 +13,117 @@ type Object struct {
 	PkType reflect.Type
 	PkAuto bool
 
+	// generator name of pk,
+	// "uuid", "ulid" or custom registered name.
+	PkGen string
+
+	// version field for optimistic concurrency.
+	Version string
+
+	// created and updated time fields.
+	Created string
+	Updated string
+
+	// expire time field.
+	Expire string
+
+	// all pk fields in struct order.
+	// more than one field means composite pk.
+	Pks     []string
+	PkTypes []reflect.Type
+
 	Index map[string]reflect.Type
 }
 
+// is composite pk by multiple fields.
+func (o *Object) IsComposite() bool {
+	return len(o.Pks) > 1
+}
+
+// get pk value of struct value.
+// composite pk returns all field values as []interface{}.
+func (o *Object) PkValue(v interface{}) interface{} {
+	rv := reflect.ValueOf(v).Elem()
+	if !o.IsComposite() {
+		return rv.FieldByName(o.Pk).Interface()
+	}
+	pk := make([]interface{}, len(o.Pks))
+	for i, field := range o.Pks {
+		pk[i] = rv.FieldByName(field).Interface()
+	}
+	return pk
+}
+
+// convert pk value to pk field types.
+// composite pk needs []interface{} of all pk fields.
+func (o *Object) ConvertPk(pk interface{}) (interface{}, error) {
+	fields, ok := pk.([]interface{})
+	if !ok {
+		fields = []interface{}{pk}
+	}
+	if len(fields) != len(o.Pks) {
+		return nil, Wrong
+	}
+	fields, e := o.convertPkFields(fields)
+	if e != nil {
+		return nil, e
+	}
+	if len(fields) == 1 {
+		return fields[0], nil
+	}
+	return fields, nil
+}
+
+// set pk fields of struct pointer by pk value.
+// composite pk needs []interface{} of all pk fields.
+// pk values are not converted, each one needs same type as its field, or it returns Wrong.
+func (o *Object) setPk(v interface{}, pk interface{}) (e error) {
+	fields, ok := pk.([]interface{})
+	if !ok {
+		fields = []interface{}{pk}
+	}
+	if len(fields) != len(o.Pks) {
+		return Wrong
+	}
+	for i, field := range fields {
+		if reflect.TypeOf(field) != o.PkTypes[i] {
+			return Wrong
+		}
+	}
+	rv := reflect.ValueOf(v).Elem()
+	for i, field := range fields {
+		rv.FieldByName(o.Pks[i]).Set(reflect.ValueOf(field))
+	}
+	return
+}
+
+// convert leading pk field values to pk field types.
+// only exact numbers are converted, other values need assignable types.
+func (o *Object) convertPkFields(values []interface{}) (fields []interface{}, e error) {
+	if len(values) > len(o.Pks) {
+		e = Wrong
+		return
+	}
+	fields = make([]interface{}, len(values))
+	for i, v := range values {
+		rv, ok := convertValue(reflect.ValueOf(v), o.PkTypes[i])
+		if !ok {
+			e = Wrong
+			return
+		}
+		fields[i] = rv.Interface()
+	}
+	return
+}
+
 // create new object from value.
-// pk field need int64,float64 or string.
-// auto pk field need int64.
+// pk field need string, int, int32, int64, uint32, uint64, float64, time.Time or byte array.
+// auto pk field need int, int32, int64, uint32 or uint64.
 // pk field must be set.
+// generated pk field by uuid and ulid need string or [16]byte,
+// by custom generator need valid pk type.
+// several pk fields make composite pk in struct order,
+// but auto or generated pk can't be composite.
 func NewObject(v interface{}) (obj *Object, e error) {
 	// parse value reflect type.
 	// need struct pointer.
@@ -43,28 +148,83 @@ func NewObject(v interface{}) (obj *Object, e error) {
 
 		// pk
 		if tag == "pk" {
-			if !isBaseType(field.Type.Kind()) {
-				e = fmt.Errorf("pk field need string, int64 or float64 : %s,%s", rt.String(), field.Name)
+			if !isPkType(field.Type) {
+				e = fmt.Errorf("pk field type %s is not supported, need string, int, int32, int64, uint32, uint64, float64, time.Time or byte array : %s,%s", field.Type.String(), rt.String(), field.Name)
 				return
 			}
-			obj.Pk = field.Name
-			obj.PkType = field.Type
-			obj.PkAuto = false
+			obj.Pks = append(obj.Pks, field.Name)
+			obj.PkTypes = append(obj.PkTypes, field.Type)
 			continue
 		}
 
 		// auto pk
 		if tag == "pk-auto" {
-			if field.Type.Kind() != reflect.Int64 {
-				e = fmt.Errorf("auto pk field need int64 : %s,%s", rt.String(), field.Name)
+			if !isAutoPkType(field.Type) {
+				e = fmt.Errorf("auto pk field type %s is not supported, need int, int32, int64, uint32 or uint64 : %s,%s", field.Type.String(), rt.String(), field.Name)
 				return
 			}
-			obj.Pk = field.Name
-			obj.PkType = field.Type
+			obj.Pks = append(obj.Pks, field.Name)
+			obj.PkTypes = append(obj.PkTypes, field.Type)
 			obj.PkAuto = true
 			continue
 		}
 
+		// generated pk
+		if tag == "pk-uuid" || tag == "pk-ulid" || strings.HasPrefix(tag, "pk-gen=") {
+			gen := strings.TrimPrefix(strings.TrimPrefix(tag, "pk-"), "gen=")
+			if gen == "uuid" || gen == "ulid" {
+				if field.Type.Kind() != reflect.String && field.Type != reflect.TypeOf([16]byte{}) {
+					e = fmt.Errorf("%s pk field type %s is not supported, need string or [16]byte : %s,%s", gen, field.Type.String(), rt.String(), field.Name)
+					return
+				}
+			} else if !isPkType(field.Type) {
+				e = fmt.Errorf("pk field type %s is not supported, need string, int, int32, int64, uint32, uint64, float64, time.Time or byte array : %s,%s", field.Type.String(), rt.String(), field.Name)
+				return
+			}
+			if len(gen) < 1 {
+				e = fmt.Errorf("pk generator need name : %s,%s", rt.String(), field.Name)
+				return
+			}
+			obj.Pks = append(obj.Pks, field.Name)
+			obj.PkTypes = append(obj.PkTypes, field.Type)
+			obj.PkGen = gen
+			continue
+		}
+
+		// version
+		if tag == "version" {
+			if field.Type.Kind() != reflect.Int64 {
+				e = fmt.Errorf("version field need int64 : %s,%s", rt.String(), field.Name)
+				return
+			}
+			obj.Version = field.Name
+			continue
+		}
+
+		// created and updated time
+		if tag == "created" || tag == "updated" {
+			if !isTimeType(field.Type) {
+				e = fmt.Errorf("%s field need time.Time or int64 : %s,%s", tag, rt.String(), field.Name)
+				return
+			}
+			if tag == "created" {
+				obj.Created = field.Name
+			} else {
+				obj.Updated = field.Name
+			}
+			continue
+		}
+
+		// expire time
+		if tag == "expire" {
+			if !isTimeType(field.Type) {
+				e = fmt.Errorf("expire field need time.Time or int64 : %s,%s", rt.String(), field.Name)
+				return
+			}
+			obj.Expire = field.Name
+			continue
+		}
+
 		// index
 		if tag == "index" {
 			obj.Index[field.Name] = field.Type
@@ -72,8 +232,15 @@ func NewObject(v interface{}) (obj *Object, e error) {
 		}
 
 	}
-	if len(obj.Pk) < 1 {
+	if len(obj.Pks) < 1 {
 		e = fmt.Errorf("need pk field : %s", rt.String())
+		return
+	}
+	if (obj.PkAuto || obj.PkGen != "") && obj.IsComposite() {
+		e = fmt.Errorf("auto or generated pk can't be composite : %s", rt.String())
+		return
 	}
+	obj.Pk = obj.Pks[0]
+	obj.PkType = obj.PkTypes[0]
 	return
 }
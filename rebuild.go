@@ -0,0 +1,190 @@
+package jx
+
+import (
+	"encoding/json"
+	"errors"
+	"github.com/fuxiaohei/jx/col"
+	"os"
+	"path"
+	"reflect"
+	"time"
+)
+
+// RebuildReport is result of rebuilding pk index from chunk data.
+// skipped frames are corrupt or truncated, their values are lost.
+type RebuildReport struct {
+	Table   string     `json:"table"`
+	Values  int        `json:"values"`
+	Frames  int        `json:"frames"`
+	Deleted int        `json:"deleted"`
+	Skipped []*Problem `json:"skipped,omitempty"`
+}
+
+// rebuild pk index of struct table from chunk data.
+// if the table is not synced, it tries syncing first.
+// if syncing fails by broken or lost pk file, pk files are reset and the table is synced again,
+// old pk file is kept as pk.pk.broken, and it's restored if rebuilding fails.
+func (s *Storage) RebuildIndex(v interface{}) (r *RebuildReport, e error) {
+	rt := getReflectType(v)
+	if tbl := s.tables[rt]; tbl != nil {
+		return tbl.RebuildIndex()
+	}
+	obj, e := NewObject(v)
+	if e != nil {
+		return
+	}
+	e = s.Sync(v)
+	if e == nil {
+		return s.tables[rt].RebuildIndex()
+	}
+	dir := path.Join(s.directory, rt.String(), "_pk")
+	if !brokenPk(e, dir) {
+		return
+	}
+	restore, e := col.ResetPkFiles(dir, obj.PkAuto)
+	if e != nil {
+		return
+	}
+	if e = s.Sync(v); e == nil {
+		if r, e = s.tables[rt].RebuildIndex(); e != nil {
+			s.tables[rt].Close()
+			delete(s.tables, rt)
+		}
+	}
+	if e != nil {
+		restore()
+	}
+	return
+}
+
+// error is caused by broken or lost pk files in directory, so they can be reset and rebuilt.
+func brokenPk(err error, dir string) bool {
+	var te *Error
+	if errors.As(err, &te) && te.Kind == ErrCorrupt {
+		return te.Path == dir
+	}
+	var pe *os.PathError
+	return errors.As(err, &pe) && os.IsNotExist(pe) && path.Dir(pe.Path) == dir
+}
+
+// rebuild pk index from chunk data, under table lock.
+// it rescans all chunk files, pk file and auto increment file are rewritten.
+func (t *Table) RebuildIndex() (r *RebuildReport, e error) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	if e = t.checkClosed(); e != nil {
+		return
+	}
+
+	now := time.Now()
+	r, e = RebuildTable(t.Pk, t.Chunk, func(data []byte) (key []byte, version int64, exp int64, e error) {
+		v := reflect.New(t.Object.DataType).Interface()
+		if e = json.Unmarshal(data, v); e != nil {
+			return
+		}
+		if key, e = col.EncodeKey(t.Object.PkValue(v)); e != nil {
+			return
+		}
+		return key, t.getVersion(v), t.expireOf(v, now), nil
+	})
+	if r != nil {
+		r.Table = t.Object.DataType.String()
+	}
+	return
+}
+
+// value frame found by rebuilding.
+type rebuildFrame struct {
+	pkValue *col.PkValue
+	version int64
+	deleted bool
+	modTime time.Time
+}
+
+// newer frame of same pk in different files wins.
+// live frame is newer than deleted frame,
+// higher version is newer, otherwise frame in last modified file is newer.
+func (f *rebuildFrame) newer(old *rebuildFrame) bool {
+	if f.deleted != old.deleted {
+		return !f.deleted
+	}
+	if f.version != old.version {
+		return f.version > old.version
+	}
+	return f.modTime.After(old.modTime)
+}
+
+// rebuild pk by chunk frames.
+// decode gets pk key bytes, version and expiration time of value data, or error if data is corrupt.
+// in one file, updated value is followed by new frame, deleted value is followed by delete mark.
+// it's used by tools without Go types.
+func RebuildTable(pk *col.PK, chunk *col.Chunk, decode func(data []byte) (key []byte, version int64, exp int64, e error)) (r *RebuildReport, e error) {
+	r = new(RebuildReport)
+	// last frame of each pk in each file
+	frames := make(map[string]map[int]*rebuildFrame)
+	var keys []string
+	var cursor int
+	var last map[int64]*rebuildFrame
+	var modTime time.Time
+	broken, e := chunk.WalkFrames(func(f *col.Frame) error {
+		if last == nil || f.Cursor != cursor {
+			fi, e := os.Stat(f.File)
+			if e != nil {
+				return e
+			}
+			cursor, modTime = f.Cursor, fi.ModTime()
+			last = make(map[int64]*rebuildFrame)
+		}
+		if f.Deleted {
+			if rf := last[f.Uid]; rf != nil {
+				rf.deleted = true
+			}
+			return nil
+		}
+		r.Frames++
+		key, version, exp, e := decode(f.Data)
+		if e != nil {
+			r.Skipped = append(r.Skipped, &Problem{Kind: ProblemCorruptFrame, File: f.File, Offset: f.Offset, Message: e.Error()})
+			return nil
+		}
+		rf := &rebuildFrame{
+			pkValue: &col.PkValue{Key: key, Cursor: f.Cursor, Uid: f.Uid, Exp: exp},
+			version: version,
+			modTime: modTime,
+		}
+		last[f.Uid] = rf
+		if frames[string(key)] == nil {
+			frames[string(key)] = make(map[int]*rebuildFrame)
+			keys = append(keys, string(key))
+		}
+		frames[string(key)][f.Cursor] = rf
+		return nil
+	})
+	if e != nil {
+		return nil, e
+	}
+	for _, b := range broken {
+		r.Skipped = append(r.Skipped, frameProblem(b))
+	}
+
+	values := make([]*col.PkValue, 0, len(keys))
+	var deleted [][]byte
+	for _, key := range keys {
+		var rf *rebuildFrame
+		for _, f := range frames[key] {
+			if rf == nil || f.newer(rf) {
+				rf = f
+			}
+		}
+		if rf.deleted {
+			deleted = append(deleted, []byte(key))
+		} else {
+			values = append(values, rf.pkValue)
+		}
+	}
+	if e = pk.Reset(values, deleted); e != nil {
+		return nil, e
+	}
+	r.Values, r.Deleted = len(values), len(deleted)
+	return r, nil
+}
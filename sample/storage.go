@@ -22,7 +22,12 @@ type Group struct {
 	UserCount int
 }
 
-// todo : complete GroupUser
+// GroupUser uses composite pk by group name and user id.
+type GroupUser struct {
+	GroupName string `jx:"pk"`
+	UserId    int64  `jx:"pk"`
+	Role      string
+}
 
 var (
 	s     *jx.Storage
@@ -39,8 +44,8 @@ func init() {
 	}
 
 	// sync struct to storage.
-	// it creates "sample.User" and "sample.Group" to save struct data files.
-	e = s.Sync(new(User), new(Group))
+	// it creates "sample.User", "sample.Group" and "sample.GroupUser" to save struct data files.
+	e = s.Sync(new(User), new(Group), new(GroupUser))
 	if e != nil {
 		panic(e)
 	}
@@ -163,6 +168,34 @@ func main() {
 	}
 	fmt.Println("update all true")
 
+	// composite pk sample ---------------
+	fmt.Println("composite pk -------------")
+
+	// put some users into one group, the pk is group name and user id.
+	groupName := randomString(4)
+	for i := 1; i <= 9; i++ {
+		gu := &GroupUser{
+			GroupName: groupName,
+			UserId:    int64(i),
+			Role:      randomString(5),
+		}
+		e := s.Insert(gu)
+		if e != nil {
+			panic(e)
+		}
+	}
+
+	// scan group users by leading pk field, group name.
+	count := 0
+	e := s.Scan(new(GroupUser), func(v interface{}) bool {
+		count++
+		return true
+	}, groupName)
+	if e != nil {
+		panic(e)
+	}
+	fmt.Printf("scan %d users in group %s\n", count, groupName)
+
 	// delete sample ---------------
 	fmt.Println("deleting -------------")
 
@@ -184,7 +217,13 @@ func main() {
 
 	// after update and delete something, many rest data are saving in files.
 	// so we can optimize files to clean them.
-	e := s.Optimize()
+	e = s.Optimize()
+	if e != nil {
+		panic(e)
+	}
+
+	// close storage, save auto increment ids.
+	e = s.Close()
 	if e != nil {
 		panic(e)
 	}
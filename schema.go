@@ -0,0 +1,105 @@
+package jx
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path"
+	"reflect"
+	"strings"
+)
+
+// name of schema file in table directory.
+const schemaFile = "schema.json"
+
+// Schema describes table pk and special fields without Go types,
+// so tools can read and write table data as json.
+type Schema struct {
+	Type    string         `json:"type"`
+	Pks     []*SchemaField `json:"pks"`
+	PkAuto  bool           `json:"pk_auto,omitempty"`
+	PkGen   string         `json:"pk_gen,omitempty"`
+	Version *SchemaField   `json:"version,omitempty"`
+	Expire  *SchemaField   `json:"expire,omitempty"`
+}
+
+// SchemaField is struct field with json name and kind.
+// kind is string, int, uint, float, time or bytes.
+// size is length of bytes kind.
+type SchemaField struct {
+	Name string `json:"name"`
+	Json string `json:"json"`
+	Kind string `json:"kind"`
+	Size int    `json:"size,omitempty"`
+}
+
+// get schema of object.
+func (o *Object) Schema() *Schema {
+	s := &Schema{
+		Type:   o.DataType.String(),
+		PkAuto: o.PkAuto,
+		PkGen:  o.PkGen,
+	}
+	for _, name := range o.Pks {
+		s.Pks = append(s.Pks, o.schemaField(name))
+	}
+	if o.Version != "" {
+		s.Version = o.schemaField(o.Version)
+	}
+	if o.Expire != "" {
+		s.Expire = o.schemaField(o.Expire)
+	}
+	return s
+}
+
+// get schema field by struct field name.
+func (o *Object) schemaField(name string) *SchemaField {
+	sf, _ := o.DataType.FieldByName(name)
+	f := &SchemaField{Name: name, Json: name}
+	if tag := strings.Split(sf.Tag.Get("json"), ",")[0]; tag != "" {
+		f.Json = tag
+	}
+	if sf.Type == timeType {
+		f.Kind = "time"
+		return f
+	}
+	switch sf.Type.Kind() {
+	case reflect.String:
+		f.Kind = "string"
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		f.Kind = "int"
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		f.Kind = "uint"
+	case reflect.Float32, reflect.Float64:
+		f.Kind = "float"
+	case reflect.Array:
+		f.Kind = "bytes"
+		f.Size = sf.Type.Len()
+	}
+	return f
+}
+
+// write schema file to table directory.
+func writeSchema(directory string, s *Schema) (e error) {
+	b, e := json.MarshalIndent(s, "", "  ")
+	if e != nil {
+		return
+	}
+	file := path.Join(directory, schemaFile)
+	if old, _ := ioutil.ReadFile(file); string(old) == string(b) {
+		return
+	}
+	e = ioutil.WriteFile(file, b, os.ModePerm)
+	return
+}
+
+// read schema file in table directory.
+func ReadSchema(directory string) (s *Schema, e error) {
+	b, e := ioutil.ReadFile(path.Join(directory, schemaFile))
+	if e != nil {
+		return
+	}
+	s = new(Schema)
+	e = json.Unmarshal(b, s)
+	return
+}
@@ -0,0 +1,113 @@
+package jx
+
+import (
+	"github.com/fuxiaohei/jx/col"
+	"sort"
+	"time"
+)
+
+// StorageStats is stats of all synced tables, with totals.
+type StorageStats struct {
+	Tables    []*TableStats `json:"tables"`
+	Records   int           `json:"records"`
+	Bytes     int64         `json:"bytes"`
+	DeadBytes int64         `json:"dead_bytes"`
+	Memory    int64         `json:"memory"`
+}
+
+// TableStats is stats of one table.
+// records are live and not expired values, pk keys include expired values.
+// pk log is frames in pk file, it grows by writing until optimizing.
+// bytes are chunk files size, dead bytes are cleaned by optimizing.
+// memory is json size of values loaded in memory, approximately.
+type TableStats struct {
+	Table         string            `json:"table"`
+	Records       int               `json:"records"`
+	PkKeys        int               `json:"pk_keys"`
+	PkLog         int               `json:"pk_log"`
+	AutoIncrement int64             `json:"auto_increment"`
+	Chunks        int               `json:"chunks"`
+	LoadedChunks  int               `json:"loaded_chunks"`
+	Bytes         int64             `json:"bytes"`
+	DeadBytes     int64             `json:"dead_bytes"`
+	Memory        int64             `json:"memory"`
+	Quarantined   int               `json:"quarantined"`
+	ChunkFiles    []*col.ChunkStats `json:"chunk_files"`
+}
+
+// get stats of all synced tables.
+func (s *Storage) Stats() (stats *StorageStats, e error) {
+	tables := s.Tables()
+	names := make([]string, 0, len(tables))
+	for name := range tables {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	stats = new(StorageStats)
+	for _, name := range names {
+		ts, e := tables[name].Stats()
+		if e != nil {
+			return nil, e
+		}
+		stats.Tables = append(stats.Tables, ts)
+		stats.Records += ts.Records
+		stats.Bytes += ts.Bytes
+		stats.DeadBytes += ts.DeadBytes
+		stats.Memory += ts.Memory
+	}
+	return
+}
+
+// get table stats, under table read lock.
+// it walks all chunk files and pk file from disk.
+func (t *Table) Stats() (stats *TableStats, e error) {
+	t.lock.RLock()
+	defer t.lock.RUnlock()
+	if e = t.checkClosed(); e != nil {
+		return
+	}
+
+	if stats, e = StatTable(t.Object.DataType.String(), t.Pk, t.Chunk); e != nil {
+		return
+	}
+	stats.Quarantined = len(t.Chunk.Quarantined())
+	return
+}
+
+// get table stats by pk and chunk.
+// it's used by tools without Go types.
+func StatTable(name string, pk *col.PK, chunk *col.Chunk) (stats *TableStats, e error) {
+	stats = &TableStats{
+		Table:         name,
+		AutoIncrement: pk.GetAutoIncrement(),
+	}
+	now := time.Now().UnixNano()
+	pkValues := pk.Prefix(nil)
+	stats.PkKeys = len(pkValues)
+	for _, pkValue := range pkValues {
+		if !pkValue.Expired(now) {
+			stats.Records++
+		}
+	}
+	if _, e = pk.WalkFrames(func(f *col.Frame) error {
+		stats.PkLog++
+		return nil
+	}); e != nil {
+		return
+	}
+
+	if stats.ChunkFiles, e = chunk.Stats(pkValues); e != nil {
+		return
+	}
+	stats.Chunks = len(stats.ChunkFiles)
+	for _, cs := range stats.ChunkFiles {
+		if cs.Loaded {
+			stats.LoadedChunks++
+		}
+		stats.Bytes += cs.Bytes
+		stats.DeadBytes += cs.DeadBytes
+		stats.Memory += cs.Memory
+	}
+	return
+}
@@ -1,8 +1,11 @@
 package jx
 
 import (
+	"context"
 	"fmt"
 	"github.com/Unknwon/com"
+	"github.com/fuxiaohei/jx/col"
+	"io"
 	"math/rand"
 	"os"
 	"path"
@@ -14,10 +17,36 @@ func init() {
 	rand.Seed(time.Now().UnixNano())
 }
 
+// Options sets storage behaviors.
+type Options struct {
+	// if true, broken frames in chunk files are skipped when loading,
+	// their bytes are copied to _quarantine directory of table with report.
+	// otherwise, the chunk file can't be loaded.
+	Tolerant bool
+
+	// called for each quarantined frame in tolerant loading.
+	OnQuarantine func(q *col.Quarantine)
+
+	// logger of chunk loading, compaction and failed operations, nil is no logging.
+	Logger Logger
+
+	// metrics of operation latencies and chunk events, nil is no metrics.
+	Metrics Metrics
+}
+
 type Storage struct {
 	directory string
+	options   Options
 
-	tables map[reflect.Type]*Table
+	tables     map[reflect.Type]*Table
+	generators map[string]Generator
+}
+
+// register pk generator by name.
+// struct field with `jx:"pk-gen=name"` uses the generator.
+// it must be registered before syncing the struct.
+func (s *Storage) Register(name string, g Generator) {
+	s.generators[name] = g
 }
 
 // get struct table.
@@ -42,19 +71,32 @@ func (s *Storage) Insert(v interface{}) (e error) {
 	rt := getReflectType(v)
 	tbl := s.tables[rt]
 	if tbl == nil {
-		e = fmt.Errorf("no sync struct : %s", rt.String())
+		e = notSynced(rt)
 		return
 	}
 	e = tbl.Insert(v)
 	return
 }
 
+// put struct value.
+// insert if its pk is not found, otherwise update.
+func (s *Storage) Put(v interface{}) (e error) {
+	rt := getReflectType(v)
+	tbl := s.tables[rt]
+	if tbl == nil {
+		e = notSynced(rt)
+		return
+	}
+	e = tbl.Put(v)
+	return
+}
+
 // get struct value by its pk field value.
 func (s *Storage) Get(v interface{}) (e error) {
 	rt := getReflectType(v)
 	tbl := s.tables[rt]
 	if tbl == nil {
-		e = fmt.Errorf("no sync struct : %s", rt.String())
+		e = notSynced(rt)
 		return
 	}
 	e = tbl.Get(v)
@@ -66,38 +108,264 @@ func (s *Storage) Delete(v interface{}) (e error) {
 	rt := getReflectType(v)
 	tbl := s.tables[rt]
 	if tbl == nil {
-		e = fmt.Errorf("no sync struct : %s", rt.String())
+		e = notSynced(rt)
 		return
 	}
 	e = tbl.Delete(v)
 	return
 }
 
-// update struct value by its pk value
+// update struct value by its pk value.
+// if not found, return error Nil.
 func (s *Storage) Update(v interface{}) (e error) {
 	rt := getReflectType(v)
 	tbl := s.tables[rt]
 	if tbl == nil {
-		e = fmt.Errorf("no sync struct : %s", rt.String())
+		e = notSynced(rt)
 		return
 	}
 	e = tbl.Update(v)
 	return
 }
 
+// update named fields of struct value by its pk value.
+// other fields are kept, v is filled by merged value.
+// if not found, return error Nil.
+func (s *Storage) UpdateFields(v interface{}, fields ...string) (e error) {
+	rt := getReflectType(v)
+	tbl := s.tables[rt]
+	if tbl == nil {
+		e = notSynced(rt)
+		return
+	}
+	e = tbl.UpdateFields(v, fields...)
+	return
+}
+
+// update fields of struct value by pk value and field values map.
+// v is struct pointer to find table, filled by updated value.
+// if not found, return error Nil.
+func (s *Storage) UpdateMap(v interface{}, pk interface{}, values map[string]interface{}) (e error) {
+	rt := getReflectType(v)
+	tbl := s.tables[rt]
+	if tbl == nil {
+		e = notSynced(rt)
+		return
+	}
+	e = tbl.UpdateMap(v, pk, values)
+	return
+}
+
+// modify struct value by pk value atomically.
+// fn gets a copy of saved value to modify, under table write lock,
+// so fn should not operate storage.
+// if fn returns error, nothing is saved.
+// v is struct pointer to find table, filled by modified value.
+func (s *Storage) Modify(v interface{}, pk interface{}, fn func(v interface{}) error) (e error) {
+	rt := getReflectType(v)
+	tbl := s.tables[rt]
+	if tbl == nil {
+		e = notSynced(rt)
+		return
+	}
+	e = tbl.Modify(v, pk, fn)
+	return
+}
+
+// increase number field of struct value by pk value atomically.
+// v is struct pointer to find table, filled by increased value.
+func (s *Storage) Incr(v interface{}, pk interface{}, field string, delta int64) (e error) {
+	rt := getReflectType(v)
+	tbl := s.tables[rt]
+	if tbl == nil {
+		e = notSynced(rt)
+		return
+	}
+	e = tbl.Incr(v, pk, field, delta)
+	return
+}
+
+// insert many struct values in slice.
+// the slice is []*T or []T of one synced struct.
+// failed values are reported by *BatchError with slice index.
+func (s *Storage) InsertMany(slice interface{}) (e error) {
+	return s.InsertManyContext(context.Background(), slice)
+}
+
+// insert many struct values in slice, unless ctx is canceled before writing.
+func (s *Storage) InsertManyContext(ctx context.Context, slice interface{}) (e error) {
+	tbl, values, e := s.batchValues(slice)
+	if e != nil || len(values) < 1 {
+		return
+	}
+	e = tbl.InsertManyContext(ctx, values)
+	return
+}
+
+// update many struct values in slice by their pk values.
+func (s *Storage) UpdateMany(slice interface{}) (e error) {
+	return s.UpdateManyContext(context.Background(), slice)
+}
+
+// update many struct values in slice, unless ctx is canceled before writing.
+func (s *Storage) UpdateManyContext(ctx context.Context, slice interface{}) (e error) {
+	tbl, values, e := s.batchValues(slice)
+	if e != nil || len(values) < 1 {
+		return
+	}
+	e = tbl.UpdateManyContext(ctx, values)
+	return
+}
+
+// delete many struct values in slice by their pk fields.
+func (s *Storage) DeleteMany(slice interface{}) (e error) {
+	return s.DeleteManyContext(context.Background(), slice)
+}
+
+// delete many struct values in slice, unless ctx is canceled before writing.
+func (s *Storage) DeleteManyContext(ctx context.Context, slice interface{}) (e error) {
+	tbl, values, e := s.batchValues(slice)
+	if e != nil || len(values) < 1 {
+		return
+	}
+	e = tbl.DeleteManyContext(ctx, values)
+	return
+}
+
+// get table and struct pointers of batch slice.
+// all values must be one synced struct.
+func (s *Storage) batchValues(slice interface{}) (tbl *Table, values []interface{}, e error) {
+	rv := reflect.ValueOf(slice)
+	if rv.Kind() != reflect.Slice {
+		e = fmt.Errorf("batch need slice : %s", rv.Type().String())
+		return
+	}
+	for i := 0; i < rv.Len(); i++ {
+		item := rv.Index(i)
+		if item.Kind() == reflect.Interface {
+			item = item.Elem()
+		}
+		if item.Kind() == reflect.Struct && item.CanAddr() {
+			item = item.Addr()
+		}
+		if item.Kind() != reflect.Ptr || item.IsNil() {
+			e = fmt.Errorf("batch need struct values : %s", rv.Type().String())
+			return
+		}
+		rt := getReflectType(item.Interface())
+		if tbl == nil {
+			if tbl = s.tables[rt]; tbl == nil {
+				e = notSynced(rt)
+				return
+			}
+		}
+		if rt != tbl.Object.DataType {
+			e = fmt.Errorf("batch need one struct : %s", rt.String())
+			return
+		}
+		values = append(values, item.Interface())
+	}
+	return
+}
+
+// scan struct values in pk order.
+// prefix values match the leading fields of composite pk,
+// no prefix means scanning all values.
+func (s *Storage) Scan(v interface{}, fn func(v interface{}) bool, prefix ...interface{}) (e error) {
+	return s.ScanContext(context.Background(), v, fn, prefix...)
+}
+
+// scan struct values in pk order until ctx is canceled.
+func (s *Storage) ScanContext(ctx context.Context, v interface{}, fn func(v interface{}) bool, prefix ...interface{}) (e error) {
+	rt := getReflectType(v)
+	tbl := s.tables[rt]
+	if tbl == nil {
+		e = notSynced(rt)
+		return
+	}
+	e = tbl.ScanContext(ctx, fn, prefix...)
+	return
+}
+
+// export struct values to writer as json lines, in pk order.
+func (s *Storage) Export(v interface{}, w io.Writer) (e error) {
+	rt := getReflectType(v)
+	tbl := s.tables[rt]
+	if tbl == nil {
+		e = notSynced(rt)
+		return
+	}
+	e = tbl.Export(w)
+	return
+}
+
+// import struct values from json lines reader.
+// it returns count of inserted or overwritten values.
+func (s *Storage) Import(v interface{}, r io.Reader, opts ImportOptions) (n int, e error) {
+	return s.ImportContext(context.Background(), v, r, opts)
+}
+
+// import struct values from json lines reader until ctx is canceled.
+func (s *Storage) ImportContext(ctx context.Context, v interface{}, r io.Reader, opts ImportOptions) (n int, e error) {
+	rt := getReflectType(v)
+	tbl := s.tables[rt]
+	if tbl == nil {
+		e = notSynced(rt)
+		return
+	}
+	n, e = tbl.ImportContext(ctx, r, opts)
+	return
+}
+
+// watch insert, update and delete changes of struct values.
+// options are optional, default buffer is 100 and not blocking.
+func (s *Storage) Watch(v interface{}, opts ...WatchOptions) (w *Watcher, e error) {
+	rt := getReflectType(v)
+	tbl := s.tables[rt]
+	if tbl == nil {
+		e = notSynced(rt)
+		return
+	}
+	var opt WatchOptions
+	if len(opts) > 0 {
+		opt = opts[0]
+	}
+	w = tbl.Watch(opt)
+	return
+}
+
 // sync struct pointer to create table.
 // it parses struct field to create or read table data.
 func (s *Storage) Sync(value ...interface{}) (e error) {
+	return s.SyncContext(context.Background(), value...)
+}
+
+// sync struct pointers until ctx is canceled.
+// ctx is checked between tables and their files, tables synced before canceling are kept.
+func (s *Storage) SyncContext(ctx context.Context, value ...interface{}) (e error) {
 	for _, v := range value {
+		if e = ctx.Err(); e != nil {
+			return
+		}
 		var obj *Object
 		obj, e = NewObject(v)
 		if e != nil {
 			return
 		}
-		s.tables[obj.DataType], e = NewTable(path.Join(s.directory, obj.DataType.String()), obj)
+		var gen Generator
+		if obj.PkGen != "" {
+			if gen = s.generators[obj.PkGen]; gen == nil {
+				e = fmt.Errorf("pk generator is not registered : %s", obj.PkGen)
+				return
+			}
+		}
+		var tbl *Table
+		tbl, e = NewTableContext(ctx, path.Join(s.directory, obj.DataType.String()), obj, s.options)
 		if e != nil {
 			return
 		}
+		tbl.Generator = gen
+		s.tables[obj.DataType] = tbl
 	}
 	return
 }
@@ -105,8 +373,25 @@ func (s *Storage) Sync(value ...interface{}) (e error) {
 // optimize storage data.
 // clean deleted data and pk.
 func (s *Storage) Optimize() (e error) {
+	return s.OptimizeContext(context.Background())
+}
+
+// optimize storage data until ctx is canceled.
+// tables optimized before canceling are kept.
+func (s *Storage) OptimizeContext(ctx context.Context) (e error) {
 	for _, tbl := range s.tables {
-		if e = tbl.Optimize(); e != nil {
+		if e = tbl.OptimizeContext(ctx); e != nil {
+			return
+		}
+	}
+	return
+}
+
+// close storage.
+// close all tables and save their auto increment ids.
+func (s *Storage) Close() (e error) {
+	for _, tbl := range s.tables {
+		if e = tbl.Close(); e != nil {
 			return
 		}
 	}
@@ -116,15 +401,20 @@ func (s *Storage) Optimize() (e error) {
 // create storage in directory.
 // it doesn't load data,
 // util call Sync(...) to load data.
-func NewStorage(directory string) (s *Storage, e error) {
+// options are optional.
+func NewStorage(directory string, opts ...Options) (s *Storage, e error) {
 	if !com.IsDir(directory) {
 		if e = os.MkdirAll(directory, os.ModePerm); e != nil {
 			return
 		}
 	}
 	s = &Storage{
-		directory: directory,
-		tables:    make(map[reflect.Type]*Table),
+		directory:  directory,
+		tables:     make(map[reflect.Type]*Table),
+		generators: defaultGenerators(),
+	}
+	if len(opts) > 0 {
+		s.options = opts[0]
 	}
 	return
 }
@@ -2,14 +2,27 @@ package jx
 
 import (
 	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"github.com/fuxiaohei/jx/col"
+	"io/ioutil"
+	"log"
 	"math/rand"
 	"os"
+	"path"
+	"path/filepath"
+	"strings"
 	"testing"
 	"time"
 )
 
 var (
 	s *Storage
+
+	// id of user inserted by TestInsert.
+	// storage is reopened without closing in init, so reserved ids are skipped.
+	insertedId int64
 )
 
 type User struct {
@@ -92,10 +105,11 @@ func TestInsert(t *testing.T) {
 		t.Error(e)
 		return
 	}
-	if u.Id != 100 {
-		t.Errorf("expect uid %d, but got %d", 100, u.Id)
+	if u.Id < 100 || u.Id > 100+col.AutoBlock {
+		t.Errorf("expect uid %d to %d, but got %d", 100, 100+col.AutoBlock, u.Id)
 		return
 	}
+	insertedId = u.Id
 }
 
 func BenchmarkInsert(b *testing.B) {
@@ -115,7 +129,7 @@ func BenchmarkInsert(b *testing.B) {
 }
 
 func TestGet(t *testing.T) {
-	u := &User{Id: 100}
+	u := &User{Id: insertedId}
 	e := s.Get(u)
 	if e != nil {
 		t.Error(e)
@@ -138,7 +152,7 @@ func BenchmarkGet(b *testing.B) {
 
 func TestUpdate(t *testing.T) {
 	u := &User{
-		Id:    100,
+		Id:    insertedId,
 		Name:  "xxxxxx",
 		Email: randomString(20),
 		Sex:   randomString(1),
@@ -150,7 +164,7 @@ func TestUpdate(t *testing.T) {
 		return
 	}
 	// get updated item
-	u2 := &User{Id: 100}
+	u2 := &User{Id: insertedId}
 	e = s.Get(u2)
 	if e != nil {
 		t.Error(e)
@@ -179,7 +193,7 @@ func BenchmarkUpdate(b *testing.B) {
 }
 
 func TestDelete(t *testing.T) {
-	u := &User{Id: 100}
+	u := &User{Id: insertedId}
 	e := s.Delete(u)
 	if e != nil {
 		t.Error(e)
@@ -201,3 +215,1909 @@ func BenchmarkDelete(b *testing.B) {
 		}
 	}
 }
+
+type GroupUser struct {
+	GroupName string `jx:"pk"`
+	UserId    int64  `jx:"pk"`
+	Role      string
+}
+
+func TestCompositePk(t *testing.T) {
+	s, e := NewStorage(t.TempDir())
+	if e != nil {
+		t.Fatal(e)
+	}
+	if e = s.Sync(new(GroupUser)); e != nil {
+		t.Fatal(e)
+	}
+	for _, name := range []string{"a", "ab", "b"} {
+		for i := 1; i <= 3; i++ {
+			if e = s.Insert(&GroupUser{GroupName: name, UserId: int64(i), Role: name}); e != nil {
+				t.Fatal(e)
+			}
+		}
+	}
+	if e = s.Insert(&GroupUser{GroupName: "a", UserId: 1}); e != Conflict {
+		t.Errorf("expect conflict, but got %v", e)
+	}
+
+	gu := &GroupUser{GroupName: "ab", UserId: 2}
+	if e = s.Get(gu); e != nil {
+		t.Fatal(e)
+	}
+	if gu.Role != "ab" {
+		t.Errorf("expect role %s, but got %s", "ab", gu.Role)
+	}
+
+	var ids []int64
+	e = s.Scan(new(GroupUser), func(v interface{}) bool {
+		ids = append(ids, v.(*GroupUser).UserId)
+		return true
+	}, "a")
+	if e != nil {
+		t.Fatal(e)
+	}
+	if len(ids) != 3 || ids[0] != 1 || ids[2] != 3 {
+		t.Errorf("expect scan ids [1 2 3], but got %v", ids)
+	}
+
+	if e = s.Delete(&GroupUser{GroupName: "a", UserId: 2}); e != nil {
+		t.Fatal(e)
+	}
+	if e = s.Get(&GroupUser{GroupName: "a", UserId: 2}); e != Nil {
+		t.Errorf("expect nil, but got %v", e)
+	}
+}
+
+type Event struct {
+	Id   uint64 `jx:"pk-auto"`
+	Name string
+}
+
+type Token struct {
+	At  time.Time `jx:"pk"`
+	Key [4]byte   `jx:"pk"`
+}
+
+func TestPkTypes(t *testing.T) {
+	s, e := NewStorage(t.TempDir())
+	if e != nil {
+		t.Fatal(e)
+	}
+	if e = s.Sync(new(Event), new(Token)); e != nil {
+		t.Fatal(e)
+	}
+
+	for i := 0; i < 12; i++ {
+		if e = s.Insert(&Event{Name: randomString(4)}); e != nil {
+			t.Fatal(e)
+		}
+	}
+	// uint64 pk is scanned in number order, not string order
+	var last uint64
+	e = s.Scan(new(Event), func(v interface{}) bool {
+		if id := v.(*Event).Id; id != last+1 {
+			t.Errorf("expect id %d, but got %d", last+1, id)
+		}
+		last++
+		return true
+	})
+	if e != nil {
+		t.Fatal(e)
+	}
+
+	at := time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC)
+	if e = s.Insert(&Token{At: at, Key: [4]byte{1, 2, 3, 4}}); e != nil {
+		t.Fatal(e)
+	}
+	// same time in another location is the same pk
+	if e = s.Get(&Token{At: at.In(time.FixedZone("x", 3600)), Key: [4]byte{1, 2, 3, 4}}); e != nil {
+		t.Error(e)
+	}
+
+	type Bad struct {
+		Id []byte `jx:"pk"`
+	}
+	if e = s.Sync(new(Bad)); e == nil {
+		t.Error("expect error of unsupported pk type")
+	}
+}
+
+type Device struct {
+	Id   string `jx:"pk-uuid"`
+	Name string
+}
+
+type Session struct {
+	Id   [16]byte `jx:"pk-ulid"`
+	Name string
+}
+
+type Node struct {
+	Id   uint64 `jx:"pk-gen=snowflake"`
+	Name string
+}
+
+func TestPkGenerator(t *testing.T) {
+	s, e := NewStorage(t.TempDir())
+	if e != nil {
+		t.Fatal(e)
+	}
+	if e = s.Sync(new(Node)); e == nil {
+		t.Error("expect error of not registered generator")
+	}
+	sf, e := NewSnowflake(1)
+	if e != nil {
+		t.Fatal(e)
+	}
+	s.Register("snowflake", sf)
+	if e = s.Sync(new(Device), new(Session), new(Node)); e != nil {
+		t.Fatal(e)
+	}
+
+	d := &Device{Name: "a"}
+	if e = s.Insert(d); e != nil {
+		t.Fatal(e)
+	}
+	if len(d.Id) != 36 || d.Id[14] != '4' {
+		t.Errorf("expect uuid v4, but got %s", d.Id)
+	}
+	// pk set already is kept
+	d2 := &Device{Id: "merged", Name: "b"}
+	if e = s.Insert(d2); e != nil || d2.Id != "merged" {
+		t.Errorf("expect kept pk, but got %s, %v", d2.Id, e)
+	}
+
+	var last [16]byte
+	for i := 0; i < 100; i++ {
+		ss := &Session{Name: "s"}
+		if e = s.Insert(ss); e != nil {
+			t.Fatal(e)
+		}
+		if bytes.Compare(ss.Id[:], last[:]) <= 0 {
+			t.Fatalf("expect increasing ulid, %x after %x", ss.Id, last)
+		}
+		last = ss.Id
+	}
+	if str := ULID(last).String(); len(str) != 26 {
+		t.Errorf("expect 26 chars ulid, but got %s", str)
+	}
+
+	n1, n2 := &Node{}, &Node{}
+	if e = s.Insert(n1); e != nil {
+		t.Fatal(e)
+	}
+	if e = s.Insert(n2); e != nil {
+		t.Fatal(e)
+	}
+	if n1.Id == 0 || n2.Id <= n1.Id {
+		t.Errorf("expect increasing snowflake ids, but got %d, %d", n1.Id, n2.Id)
+	}
+}
+
+func TestAutoIncrementRecover(t *testing.T) {
+	dir := t.TempDir()
+	s, e := NewStorage(dir)
+	if e != nil {
+		t.Fatal(e)
+	}
+	if e = s.Sync(new(User)); e != nil {
+		t.Fatal(e)
+	}
+	for i := 0; i < 5; i++ {
+		if e = s.Insert(&User{Name: randomString(4)}); e != nil {
+			t.Fatal(e)
+		}
+	}
+
+	// not closed as crash, reserved ids are skipped
+	s, e = NewStorage(dir)
+	if e != nil {
+		t.Fatal(e)
+	}
+	if e = s.Sync(new(User)); e != nil {
+		t.Fatal(e)
+	}
+	u := &User{Name: randomString(4)}
+	if e = s.Insert(u); e != nil {
+		t.Fatal(e)
+	}
+	if u.Id <= 5 {
+		t.Errorf("expect id larger than %d, but got %d", 5, u.Id)
+	}
+
+	// closed, continue from max id
+	if e = s.Close(); e != nil {
+		t.Fatal(e)
+	}
+	s, e = NewStorage(dir)
+	if e != nil {
+		t.Fatal(e)
+	}
+	if e = s.Sync(new(User)); e != nil {
+		t.Fatal(e)
+	}
+	u2 := &User{Name: randomString(4)}
+	if e = s.Insert(u2); e != nil {
+		t.Fatal(e)
+	}
+	if u2.Id != u.Id+1 {
+		t.Errorf("expect id %d, but got %d", u.Id+1, u2.Id)
+	}
+	s.Close()
+}
+
+func TestBatch(t *testing.T) {
+	s, e := NewStorage(t.TempDir())
+	if e != nil {
+		t.Fatal(e)
+	}
+	if e = s.Sync(new(User), new(GroupUser)); e != nil {
+		t.Fatal(e)
+	}
+	defer s.Close()
+
+	// over chunk limit, move to next chunk file in batch
+	users := make([]User, 1500)
+	for i := range users {
+		users[i].Name = randomString(6)
+	}
+	if e = s.InsertMany(users); e != nil {
+		t.Fatal(e)
+	}
+	if users[1499].Id != 1500 {
+		t.Errorf("expect id %d, but got %d", 1500, users[1499].Id)
+	}
+
+	gus := []*GroupUser{
+		{GroupName: "a", UserId: 1},
+		{GroupName: "", UserId: 2},
+		{GroupName: "a", UserId: 1},
+		{GroupName: "a", UserId: 3},
+	}
+	e = s.InsertMany(gus)
+	be, ok := e.(*BatchError)
+	if !ok {
+		t.Fatalf("expect batch error, but got %v", e)
+	}
+	if len(be.Errors) != 2 || !errors.Is(be.Errors[1], Wrong) || be.Errors[2] != Conflict {
+		t.Errorf("expect wrong and conflict items, but got %v", be.Errors)
+	}
+
+	users[0].Name, users[1200].Name = "first", "last"
+	if e = s.UpdateMany([]*User{&users[0], &users[1200]}); e != nil {
+		t.Fatal(e)
+	}
+	u := &User{Id: users[1200].Id}
+	if e = s.Get(u); e != nil || u.Name != "last" {
+		t.Errorf("expect name %s, but got %s, %v", "last", u.Name, e)
+	}
+
+	// duplicated pk is deleted once
+	w, e := s.Watch(new(User))
+	if e != nil {
+		t.Fatal(e)
+	}
+	batch := append(append([]User{}, users[:10]...), users[0])
+	if e = s.DeleteMany(batch); e == nil || len(e.(*BatchError).Errors) != 1 || !errors.Is(e.(*BatchError).Errors[10], Conflict) {
+		t.Fatalf("expect conflict of duplicated pk, but got %v", e)
+	}
+	w.Unsubscribe()
+	if len(w.C) != 10 {
+		t.Errorf("expect %d delete changes, but got %d", 10, len(w.C))
+	}
+	count := 0
+	s.Scan(new(User), func(v interface{}) bool {
+		count++
+		return true
+	})
+	if count != 1490 {
+		t.Errorf("expect %d users, but got %d", 1490, count)
+	}
+}
+
+func TestPut(t *testing.T) {
+	s, e := NewStorage(t.TempDir())
+	if e != nil {
+		t.Fatal(e)
+	}
+	if e = s.Sync(new(User), new(GroupUser)); e != nil {
+		t.Fatal(e)
+	}
+	defer s.Close()
+
+	if e = s.Update(&User{Id: 1}); e != Nil {
+		t.Errorf("expect nil, but got %v", e)
+	}
+
+	u := &User{Name: "a"}
+	if e = s.Put(u); e != nil || u.Id != 1 {
+		t.Fatalf("expect inserted id %d, but got %d, %v", 1, u.Id, e)
+	}
+	u.Name = "b"
+	if e = s.Put(u); e != nil {
+		t.Fatal(e)
+	}
+	u2 := &User{Id: 1}
+	if e = s.Get(u2); e != nil || u2.Name != "b" {
+		t.Errorf("expect name %s, but got %s, %v", "b", u2.Name, e)
+	}
+
+	gu := &GroupUser{GroupName: "a", UserId: 1, Role: "x"}
+	if e = s.Put(gu); e != nil {
+		t.Fatal(e)
+	}
+	gu.Role = "y"
+	if e = s.Put(gu); e != nil {
+		t.Fatal(e)
+	}
+	gu2 := &GroupUser{GroupName: "a", UserId: 1}
+	if e = s.Get(gu2); e != nil || gu2.Role != "y" {
+		t.Errorf("expect role %s, but got %s, %v", "y", gu2.Role, e)
+	}
+}
+
+type Note struct {
+	Id   int64 `jx:"pk"`
+	Temp int   `json:"-"`
+	priv int
+}
+
+func TestUpdateFields(t *testing.T) {
+	s, e := NewStorage(t.TempDir())
+	if e != nil {
+		t.Fatal(e)
+	}
+	if e = s.Sync(new(User), new(GroupUser)); e != nil {
+		t.Fatal(e)
+	}
+	defer s.Close()
+
+	u := &User{Name: "a", Email: "a@a.com", Age: 10}
+	if e = s.Insert(u); e != nil {
+		t.Fatal(e)
+	}
+	// memory value is not changed by inserted pointer
+	u.Name = "changed"
+
+	u2 := &User{Id: u.Id, Email: "b@b.com"}
+	if e = s.UpdateFields(u2, "Email"); e != nil {
+		t.Fatal(e)
+	}
+	if u2.Name != "a" || u2.Age != 10 || u2.Email != "b@b.com" {
+		t.Errorf("expect merged value, but got %v", u2)
+	}
+	if e = s.UpdateFields(u2, "Id"); e == nil {
+		t.Error("expect error of updating pk field")
+	}
+	if e = s.Sync(new(Note)); e != nil {
+		t.Fatal(e)
+	}
+	if e = s.Insert(&Note{Id: 1}); e != nil {
+		t.Fatal(e)
+	}
+	for _, field := range []string{"priv", "Temp"} {
+		if e = s.UpdateFields(&Note{Id: 1}, field); e == nil {
+			t.Errorf("expect error of updating field %s", field)
+		}
+		if e = s.UpdateMap(new(Note), 1, map[string]interface{}{field: 1}); e == nil {
+			t.Errorf("expect error of updating field %s", field)
+		}
+		if e = s.Incr(new(Note), 1, field, 1); e == nil {
+			t.Errorf("expect error of increasing field %s", field)
+		}
+	}
+	if e = s.UpdateFields(&User{Id: 99}, "Email"); e != Nil {
+		t.Errorf("expect nil, but got %v", e)
+	}
+
+	u3 := new(User)
+	if e = s.UpdateMap(u3, 1, map[string]interface{}{"Age": int64(20), "Sex": nil}); e != nil {
+		t.Fatal(e)
+	}
+	if u3.Id != 1 || u3.Age != 20 || u3.Email != "b@b.com" {
+		t.Errorf("expect updated value, but got %v", u3)
+	}
+	// values are not converted to other kinds or truncated
+	for _, values := range []map[string]interface{}{{"Name": 66}, {"Age": 1.5}, {"Age": "20"}} {
+		if e = s.UpdateMap(u3, 1, values); e == nil {
+			t.Errorf("expect error of updating %v", values)
+		}
+	}
+	if e = s.UpdateMap(u3, 1, map[string]interface{}{"Age": 21.0}); e != nil || u3.Age != 21 || u3.Name != "a" {
+		t.Errorf("expect exact number updated, but got %v, %v", u3, e)
+	}
+
+	if e = s.Insert(&GroupUser{GroupName: "a", UserId: 1, Role: "x"}); e != nil {
+		t.Fatal(e)
+	}
+	gu := new(GroupUser)
+	if e = s.UpdateMap(gu, []interface{}{"a", 1}, map[string]interface{}{"Role": "y"}); e != nil {
+		t.Fatal(e)
+	}
+	if gu.Role != "y" || gu.GroupName != "a" {
+		t.Errorf("expect updated value, but got %v", gu)
+	}
+}
+
+type Doc struct {
+	Id      int64 `jx:"pk-auto"`
+	Title   string
+	Version int64 `jx:"version"`
+}
+
+func TestVersion(t *testing.T) {
+	s, e := NewStorage(t.TempDir())
+	if e != nil {
+		t.Fatal(e)
+	}
+	if e = s.Sync(new(Doc)); e != nil {
+		t.Fatal(e)
+	}
+	defer s.Close()
+
+	d := &Doc{Title: "a"}
+	if e = s.Insert(d); e != nil {
+		t.Fatal(e)
+	}
+	if d.Version != 1 {
+		t.Errorf("expect version %d, but got %d", 1, d.Version)
+	}
+
+	// two editors get same version
+	d1, d2 := &Doc{Id: d.Id}, &Doc{Id: d.Id}
+	s.Get(d1)
+	s.Get(d2)
+	d1.Title = "b"
+	if e = s.Update(d1); e != nil {
+		t.Fatal(e)
+	}
+	if d1.Version != 2 {
+		t.Errorf("expect version %d, but got %d", 2, d1.Version)
+	}
+	d2.Title = "c"
+	if e = s.Update(d2); e != ErrStaleVersion {
+		t.Errorf("expect stale version, but got %v", e)
+	}
+	if e = s.UpdateFields(d2, "Title"); e != ErrStaleVersion {
+		t.Errorf("expect stale version, but got %v", e)
+	}
+	if e = s.UpdateMany([]*Doc{d1, d1}); e == nil || e.(*BatchError).Errors[1] != Conflict {
+		t.Errorf("expect conflict in batch, but got %v", e)
+	}
+	if d1.Version != 3 {
+		t.Errorf("expect version %d, but got %d", 3, d1.Version)
+	}
+	if e = s.Delete(d2); e != ErrStaleVersion {
+		t.Errorf("expect stale version, but got %v", e)
+	}
+	if e = s.Delete(d1); e != nil {
+		t.Fatal(e)
+	}
+}
+
+type Group struct {
+	Name      string `jx:"pk"`
+	Bio       string
+	UserCount int
+}
+
+func TestModifyIncr(t *testing.T) {
+	s, e := NewStorage(t.TempDir())
+	if e != nil {
+		t.Fatal(e)
+	}
+	if e = s.Sync(new(Group)); e != nil {
+		t.Fatal(e)
+	}
+	defer s.Close()
+
+	if e = s.Insert(&Group{Name: "a"}); e != nil {
+		t.Fatal(e)
+	}
+
+	done := make(chan error)
+	for i := 0; i < 10; i++ {
+		go func() {
+			for j := 0; j < 10; j++ {
+				if e := s.Incr(new(Group), "a", "UserCount", 1); e != nil {
+					done <- e
+					return
+				}
+			}
+			done <- nil
+		}()
+	}
+	for i := 0; i < 10; i++ {
+		if e = <-done; e != nil {
+			t.Fatal(e)
+		}
+	}
+	g := &Group{Name: "a"}
+	if e = s.Get(g); e != nil || g.UserCount != 100 {
+		t.Errorf("expect user count %d, but got %d, %v", 100, g.UserCount, e)
+	}
+
+	e = s.Modify(g, "a", func(v interface{}) error {
+		v.(*Group).Bio = "bio"
+		return nil
+	})
+	if e != nil || g.Bio != "bio" || g.UserCount != 100 {
+		t.Errorf("expect modified value, but got %v, %v", g, e)
+	}
+	e = s.Modify(g, "a", func(v interface{}) error {
+		v.(*Group).Name = "b"
+		return nil
+	})
+	if e == nil {
+		t.Error("expect error of modifying pk")
+	}
+	if e = s.Incr(g, "a", "Bio", 1); e == nil {
+		t.Error("expect error of not number field")
+	}
+	if e = s.Incr(g, "x", "UserCount", 1); e != Nil {
+		t.Errorf("expect nil, but got %v", e)
+	}
+
+	// int pk is not converted to string pk "A"
+	if e = s.Insert(&Group{Name: "A"}); e != nil {
+		t.Fatal(e)
+	}
+	e = s.Modify(g, 65, func(v interface{}) error {
+		v.(*Group).Bio = "changed"
+		return nil
+	})
+	if !errors.Is(e, Wrong) {
+		t.Errorf("expect wrong pk, but got %v", e)
+	}
+	if e = s.Sync(new(Token)); e != nil {
+		t.Fatal(e)
+	}
+	if e = s.Modify(new(Token), []interface{}{time.Now(), []byte{1, 2}}, func(v interface{}) error {
+		return nil
+	}); !errors.Is(e, Wrong) {
+		t.Errorf("expect wrong pk, but got %v", e)
+	}
+}
+
+type Post struct {
+	Id        int64 `jx:"pk-auto"`
+	Title     string
+	CreatedAt time.Time `jx:"created"`
+	UpdatedAt int64     `jx:"updated"`
+}
+
+func TestTimes(t *testing.T) {
+	s, e := NewStorage(t.TempDir())
+	if e != nil {
+		t.Fatal(e)
+	}
+	if e = s.Sync(new(Post)); e != nil {
+		t.Fatal(e)
+	}
+	defer s.Close()
+
+	p := &Post{Title: "a"}
+	if e = s.Insert(p); e != nil {
+		t.Fatal(e)
+	}
+	if p.CreatedAt.IsZero() || p.UpdatedAt == 0 {
+		t.Fatalf("expect created and updated times, but got %v", p)
+	}
+
+	// created time is kept even if passing zero
+	p2 := &Post{Id: p.Id, Title: "b"}
+	if e = s.Update(p2); e != nil {
+		t.Fatal(e)
+	}
+	if !p2.CreatedAt.Equal(p.CreatedAt) || p2.UpdatedAt < p.UpdatedAt {
+		t.Errorf("expect kept created time, but got %v", p2)
+	}
+	p3 := &Post{Id: p.Id}
+	s.Get(p3)
+	if !p3.CreatedAt.Equal(p.CreatedAt) {
+		t.Errorf("expect saved created time %v, but got %v", p.CreatedAt, p3.CreatedAt)
+	}
+
+	ps := []*Post{{Title: "c"}, {Title: "d"}}
+	if e = s.InsertMany(ps); e != nil {
+		t.Fatal(e)
+	}
+	ps[0].CreatedAt = time.Time{}
+	if e = s.UpdateMany(ps); e != nil {
+		t.Fatal(e)
+	}
+	if ps[0].CreatedAt.IsZero() || ps[1].UpdatedAt == 0 {
+		t.Errorf("expect times in batch, but got %v", ps)
+	}
+}
+
+type Token2 struct {
+	Key      string    `jx:"pk"`
+	ExpireAt time.Time `jx:"expire"`
+}
+
+func TestExpire(t *testing.T) {
+	dir := t.TempDir()
+	s, e := NewStorage(dir)
+	if e != nil {
+		t.Fatal(e)
+	}
+	if e = s.Sync(new(Token2), new(Group)); e != nil {
+		t.Fatal(e)
+	}
+	s.Table(new(Group)).SetTTL(50 * time.Millisecond)
+
+	if e = s.Insert(&Token2{Key: "a", ExpireAt: time.Now().Add(50 * time.Millisecond)}); e != nil {
+		t.Fatal(e)
+	}
+	if e = s.Insert(&Token2{Key: "b"}); e != nil {
+		t.Fatal(e)
+	}
+	if e = s.Insert(&Group{Name: "g"}); e != nil {
+		t.Fatal(e)
+	}
+	if e = s.Get(&Token2{Key: "a"}); e != nil {
+		t.Fatal(e)
+	}
+
+	time.Sleep(60 * time.Millisecond)
+	if e = s.Get(&Token2{Key: "a"}); e != Nil {
+		t.Errorf("expect nil, but got %v", e)
+	}
+	if e = s.Get(&Group{Name: "g"}); e != Nil {
+		t.Errorf("expect nil, but got %v", e)
+	}
+	if e = s.Update(&Token2{Key: "a"}); e != Nil {
+		t.Errorf("expect nil, but got %v", e)
+	}
+	count := 0
+	s.Scan(new(Token2), func(v interface{}) bool {
+		count++
+		return true
+	})
+	if count != 1 {
+		t.Errorf("expect %d values, but got %d", 1, count)
+	}
+
+	// expired pk can be inserted again
+	if e = s.Insert(&Group{Name: "g"}); e != nil {
+		t.Fatal(e)
+	}
+	time.Sleep(60 * time.Millisecond)
+	if e = s.Optimize(); e != nil {
+		t.Fatal(e)
+	}
+	if e = s.Close(); e != nil {
+		t.Fatal(e)
+	}
+
+	// purged after optimizing and reopening
+	time.Sleep(10 * time.Millisecond)
+	s, e = NewStorage(dir)
+	if e != nil {
+		t.Fatal(e)
+	}
+	if e = s.Sync(new(Token2), new(Group)); e != nil {
+		t.Fatal(e)
+	}
+	defer s.Close()
+	tbl := s.Table(new(Group))
+	if len(tbl.Pk.Prefix(nil)) != 0 {
+		t.Errorf("expect no pk, but got %d", len(tbl.Pk.Prefix(nil)))
+	}
+	if e = s.Get(&Token2{Key: "b"}); e != nil {
+		t.Error(e)
+	}
+}
+
+type Member struct {
+	Email   string `jx:"pk"`
+	Name    string
+	Display string `json:"-"`
+	events  []string
+}
+
+func (m *Member) BeforeInsert() error {
+	m.Email = strings.ToLower(m.Email)
+	if m.Name == "" {
+		return errors.New("name is empty")
+	}
+	m.events = append(m.events, "before-insert")
+	return nil
+}
+
+func (m *Member) AfterInsert() {
+	m.events = append(m.events, "after-insert")
+}
+
+func (m *Member) BeforeUpdate() error {
+	if m.Name == "" {
+		return errors.New("name is empty")
+	}
+	m.events = append(m.events, "before-update")
+	return nil
+}
+
+func (m *Member) AfterUpdate() {
+	m.events = append(m.events, "after-update")
+}
+
+func (m *Member) BeforeDelete() error {
+	if m.Email == "admin@abc.com" {
+		return errors.New("admin can't be deleted")
+	}
+	return nil
+}
+
+func (m *Member) AfterDelete() {
+	m.events = append(m.events, "after-delete")
+}
+
+func (m *Member) AfterLoad() {
+	m.Display = m.Name + " <" + m.Email + ">"
+}
+
+func TestHooks(t *testing.T) {
+	s, e := NewStorage(t.TempDir())
+	if e != nil {
+		t.Fatal(e)
+	}
+	defer s.Close()
+	if e = s.Sync(new(Member)); e != nil {
+		t.Fatal(e)
+	}
+
+	m := &Member{Email: "Admin@ABC.com", Name: "admin"}
+	if e = s.Insert(m); e != nil {
+		t.Fatal(e)
+	}
+	if m.Email != "admin@abc.com" {
+		t.Errorf("expect normalized email, but got %s", m.Email)
+	}
+	if e = s.Insert(&Member{Email: "nobody@abc.com"}); e == nil {
+		t.Error("expect error from BeforeInsert")
+	}
+	if e = s.Get(&Member{Email: "nobody@abc.com"}); e != Nil {
+		t.Errorf("expect nil, but got %v", e)
+	}
+
+	m2 := &Member{Email: "admin@abc.com"}
+	if e = s.Get(m2); e != nil {
+		t.Fatal(e)
+	}
+	if m2.Display != "admin <admin@abc.com>" {
+		t.Errorf("expect display after loading, but got %s", m2.Display)
+	}
+
+	m.Name = ""
+	if e = s.Update(m); e == nil {
+		t.Error("expect error from BeforeUpdate")
+	}
+	m.Name = "root"
+	if e = s.Update(m); e != nil {
+		t.Fatal(e)
+	}
+	if e = s.Delete(m); e == nil {
+		t.Error("expect error from BeforeDelete")
+	}
+
+	expect := []string{"before-insert", "after-insert", "before-update", "after-update"}
+	if strings.Join(m.events, ",") != strings.Join(expect, ",") {
+		t.Errorf("expect events %v, but got %v", expect, m.events)
+	}
+
+	e = s.InsertMany([]*Member{{Email: "a@abc.com", Name: "a"}, {Email: "b@abc.com"}})
+	if be, ok := e.(*BatchError); !ok || len(be.Errors) != 1 || be.Errors[1] == nil {
+		t.Errorf("expect batch error of item 1, but got %v", e)
+	}
+	u := &Member{Email: "a@abc.com"}
+	if e = s.Delete(u); e != nil {
+		t.Fatal(e)
+	}
+	if len(u.events) != 1 || u.events[0] != "after-delete" {
+		t.Errorf("expect after-delete, but got %v", u.events)
+	}
+}
+
+func TestWatch(t *testing.T) {
+	s, e := NewStorage(t.TempDir())
+	if e != nil {
+		t.Fatal(e)
+	}
+	defer s.Close()
+	if e = s.Sync(new(Group)); e != nil {
+		t.Fatal(e)
+	}
+	w, e := s.Watch(new(Group))
+	if e != nil {
+		t.Fatal(e)
+	}
+
+	g := &Group{Name: "admin", Bio: "a"}
+	if e = s.Insert(g); e != nil {
+		t.Fatal(e)
+	}
+	g.Bio = "b"
+	if e = s.Update(g); e != nil {
+		t.Fatal(e)
+	}
+	if e = s.Delete(g); e != nil {
+		t.Fatal(e)
+	}
+	if e = s.InsertMany([]*Group{{Name: "a"}, {Name: "b"}}); e != nil {
+		t.Fatal(e)
+	}
+
+	c := <-w.C
+	if c.Type != ChangeInsert || c.Pk != "admin" || c.Old != nil || c.New.(*Group).Bio != "a" {
+		t.Errorf("wrong insert change : %+v", c)
+	}
+	c = <-w.C
+	if c.Type != ChangeUpdate || c.Old.(*Group).Bio != "a" || c.New.(*Group).Bio != "b" {
+		t.Errorf("wrong update change : %+v", c)
+	}
+	c = <-w.C
+	if c.Type != ChangeDelete || c.Pk != "admin" || c.Old.(*Group).Bio != "b" || c.New != nil {
+		t.Errorf("wrong delete change : %+v", c)
+	}
+	for _, name := range []string{"a", "b"} {
+		if c = <-w.C; c.Type != ChangeInsert || c.Pk != name {
+			t.Errorf("wrong insert change : %+v", c)
+		}
+	}
+
+	w.Unsubscribe()
+	if _, ok := <-w.C; ok {
+		t.Error("expect closed channel after unsubscribing")
+	}
+	if w.Err() != nil {
+		t.Error(w.Err())
+	}
+
+	// overflow closes not blocking watcher
+	w, _ = s.Watch(new(Group), WatchOptions{Buffer: 1})
+	for _, name := range []string{"c", "d"} {
+		if e = s.Insert(&Group{Name: name}); e != nil {
+			t.Fatal(e)
+		}
+	}
+	count := 0
+	for range w.C {
+		count++
+	}
+	if count != 1 || w.Err() != ErrWatcherOverflow {
+		t.Errorf("expect overflow after %d change, but got %d, %v", 1, count, w.Err())
+	}
+
+	// watcher operates storage when receiving, writing does not wait for it
+	w, _ = s.Watch(new(Group), WatchOptions{Buffer: 10})
+	done := make(chan bool)
+	go func() {
+		for c := range w.C {
+			if c.Type == ChangeInsert {
+				s.Get(&Group{Name: c.Pk.(string)})
+			}
+		}
+		done <- true
+	}()
+	for _, name := range []string{"e", "f", "g"} {
+		if e = s.Insert(&Group{Name: name}); e != nil {
+			t.Fatal(e)
+		}
+	}
+	w.Unsubscribe()
+	<-done
+
+	// expired values removed by inserting and optimizing are deleted changes
+	s.Table(new(Group)).SetTTL(20 * time.Millisecond)
+	for _, name := range []string{"h", "i"} {
+		if e = s.Insert(&Group{Name: name, Bio: "old"}); e != nil {
+			t.Fatal(e)
+		}
+	}
+	time.Sleep(30 * time.Millisecond)
+	s.Table(new(Group)).SetTTL(0)
+	w, _ = s.Watch(new(Group))
+	if e = s.Insert(&Group{Name: "h", Bio: "new"}); e != nil {
+		t.Fatal(e)
+	}
+	if c = <-w.C; c.Type != ChangeDelete || c.Pk != "h" || c.Old.(*Group).Bio != "old" {
+		t.Errorf("wrong expired change : %+v", c)
+	}
+	if c = <-w.C; c.Type != ChangeInsert || c.Pk != "h" {
+		t.Errorf("wrong insert change : %+v", c)
+	}
+	if e = s.Optimize(); e != nil {
+		t.Fatal(e)
+	}
+	deleted := make(map[interface{}]bool)
+	for len(w.C) > 0 {
+		if c = <-w.C; c.Type == ChangeDelete {
+			deleted[c.Pk] = true
+		}
+	}
+	if !deleted["i"] || deleted["h"] {
+		t.Errorf("wrong expired changes of optimizing : %v", deleted)
+	}
+	w.Unsubscribe()
+}
+
+func TestBackup(t *testing.T) {
+	dir := t.TempDir()
+	s, e := NewStorage(path.Join(dir, "data"))
+	if e != nil {
+		t.Fatal(e)
+	}
+	if e = s.Sync(new(User), new(Group)); e != nil {
+		t.Fatal(e)
+	}
+	for i := 0; i < 50; i++ {
+		if e = s.Insert(&User{Name: randomString(8)}); e != nil {
+			t.Fatal(e)
+		}
+	}
+	if e = s.Insert(&Group{Name: "admin"}); e != nil {
+		t.Fatal(e)
+	}
+
+	// keep writing when backup
+	stop := make(chan bool)
+	done := make(chan bool)
+	go func() {
+		for {
+			select {
+			case <-stop:
+				done <- true
+				return
+			default:
+				s.Insert(&User{Name: randomString(8)})
+			}
+		}
+	}()
+	var buf bytes.Buffer
+	e = s.Backup(&buf)
+	close(stop)
+	<-done
+	if e != nil {
+		t.Fatal(e)
+	}
+	s.Close()
+
+	manifest, e := VerifyBackup(bytes.NewReader(buf.Bytes()))
+	if e != nil {
+		t.Fatal(e)
+	}
+	if len(manifest.Files) < 5 {
+		t.Errorf("expect data, pk and auto files, but got %d", len(manifest.Files))
+	}
+
+	restoreDir := path.Join(dir, "restore")
+	if e = Restore(bytes.NewReader(buf.Bytes()), restoreDir); e != nil {
+		t.Fatal(e)
+	}
+	s2, e := NewStorage(restoreDir)
+	if e != nil {
+		t.Fatal(e)
+	}
+	defer s2.Close()
+	if e = s2.Sync(new(User), new(Group)); e != nil {
+		t.Fatal(e)
+	}
+	if e = s2.Get(&Group{Name: "admin"}); e != nil {
+		t.Error(e)
+	}
+	count := 0
+	e = s2.Scan(new(User), func(v interface{}) bool {
+		count++
+		return true
+	})
+	if e != nil {
+		t.Fatal(e)
+	}
+	if count < 50 {
+		t.Errorf("expect at least %d users, but got %d", 50, count)
+	}
+	u := new(User)
+	if e = s2.Insert(u); e != nil {
+		t.Fatal(e)
+	}
+	if u.Id <= int64(count) {
+		t.Errorf("expect new id over %d, but got %d", count, u.Id)
+	}
+
+	// broken archive
+	b := buf.Bytes()
+	b[bytes.Index(b, []byte("admin"))] ^= 0xff
+	if _, e = VerifyBackup(bytes.NewReader(b)); e == nil {
+		t.Error("expect error of broken archive")
+	}
+	if e = Restore(bytes.NewReader(b), path.Join(dir, "broken")); e == nil {
+		t.Error("expect error of broken archive")
+	}
+	if _, e = os.Stat(path.Join(dir, "broken")); !os.IsNotExist(e) {
+		t.Error("expect nothing restored from broken archive")
+	}
+}
+
+func TestExportImport(t *testing.T) {
+	s, e := NewStorage(t.TempDir())
+	if e != nil {
+		t.Fatal(e)
+	}
+	defer s.Close()
+	if e = s.Sync(new(User), new(Group)); e != nil {
+		t.Fatal(e)
+	}
+	for i := 0; i < 5; i++ {
+		if e = s.Insert(&User{Name: randomString(8)}); e != nil {
+			t.Fatal(e)
+		}
+	}
+	s.Delete(&User{Id: 2})
+
+	var buf bytes.Buffer
+	if e = s.Export(new(User), &buf); e != nil {
+		t.Fatal(e)
+	}
+	lines := strings.Split(strings.TrimSpace(buf.String()), "\n")
+	if len(lines) != 4 || !strings.HasPrefix(lines[0], `{"Id":1,`) || !strings.HasPrefix(lines[3], `{"Id":5,`) {
+		t.Fatalf("wrong export lines : %v", lines)
+	}
+
+	s2, e := NewStorage(t.TempDir())
+	if e != nil {
+		t.Fatal(e)
+	}
+	defer s2.Close()
+	if e = s2.Sync(new(User), new(Group)); e != nil {
+		t.Fatal(e)
+	}
+	if e = s2.Insert(&User{Name: "first"}); e != nil {
+		t.Fatal(e)
+	}
+	if _, e = s2.Import(new(User), bytes.NewReader(buf.Bytes()), ImportOptions{}); e != Conflict {
+		t.Errorf("expect conflict, but got %v", e)
+	}
+	n, e := s2.Import(new(User), bytes.NewReader(buf.Bytes()), ImportOptions{Conflict: ConflictSkip})
+	if e != nil {
+		t.Fatal(e)
+	}
+	if n != 3 {
+		t.Errorf("expect %d imported, but got %d", 3, n)
+	}
+	u := &User{Id: 1}
+	if s2.Get(u); u.Name != "first" {
+		t.Errorf("expect skipped value, but got %s", u.Name)
+	}
+	if _, e = s2.Import(new(User), bytes.NewReader(buf.Bytes()), ImportOptions{Conflict: ConflictOverwrite}); e != nil {
+		t.Fatal(e)
+	}
+	if s2.Get(u); u.Name == "first" {
+		t.Error("expect overwritten value")
+	}
+	if e = s2.Get(&User{Id: 2}); e != Nil {
+		t.Errorf("expect nil, but got %v", e)
+	}
+
+	// auto increment id is advanced past imported ids
+	u = new(User)
+	if e = s2.Insert(u); e != nil {
+		t.Fatal(e)
+	}
+	if u.Id != 6 {
+		t.Errorf("expect id %d, but got %d", 6, u.Id)
+	}
+
+	if _, e = s2.Import(new(Group), strings.NewReader(`{"Name":"a"}`+"\n"+`{"Name":`), ImportOptions{}); e == nil {
+		t.Error("expect error of broken line")
+	}
+	if e = s2.Get(&Group{Name: "a"}); e != nil {
+		t.Error(e)
+	}
+
+	// version and time fields are imported as exported
+	if e = s.Sync(new(Doc)); e != nil {
+		t.Fatal(e)
+	}
+	d := &Doc{Title: "a"}
+	if e = s.Insert(d); e != nil {
+		t.Fatal(e)
+	}
+	for i := 0; i < 4; i++ {
+		if e = s.Update(d); e != nil {
+			t.Fatal(e)
+		}
+	}
+	buf.Reset()
+	if e = s.Export(new(Doc), &buf); e != nil {
+		t.Fatal(e)
+	}
+	if e = s2.Sync(new(Doc), new(Post)); e != nil {
+		t.Fatal(e)
+	}
+	for _, policy := range []ConflictPolicy{ConflictFail, ConflictOverwrite} {
+		if _, e = s2.Import(new(Doc), bytes.NewReader(buf.Bytes()), ImportOptions{Conflict: policy}); e != nil {
+			t.Fatal(e)
+		}
+		d2 := &Doc{Id: d.Id}
+		if e = s2.Get(d2); e != nil || d2.Version != 5 {
+			t.Errorf("expect imported version %d, but got %d, %v", 5, d2.Version, e)
+		}
+	}
+	post := `{"Id":1,"Title":"a","CreatedAt":"2020-01-01T00:00:00Z","UpdatedAt":1577836800}`
+	for _, policy := range []ConflictPolicy{ConflictFail, ConflictOverwrite} {
+		if _, e = s2.Import(new(Post), strings.NewReader(post), ImportOptions{Conflict: policy}); e != nil {
+			t.Fatal(e)
+		}
+		p := &Post{Id: 1}
+		if e = s2.Get(p); e != nil || p.CreatedAt.Unix() != 1577836800 || p.UpdatedAt != 1577836800 {
+			t.Errorf("expect imported times, but got %+v, %v", p, e)
+		}
+	}
+}
+
+func TestVerify(t *testing.T) {
+	dir := t.TempDir()
+	s, e := NewStorage(dir)
+	if e != nil {
+		t.Fatal(e)
+	}
+	if e = s.Sync(new(User), new(Group)); e != nil {
+		t.Fatal(e)
+	}
+	for i := 0; i < 5; i++ {
+		if e = s.Insert(&User{Name: randomString(8)}); e != nil {
+			t.Fatal(e)
+		}
+	}
+	s.Update(&User{Id: 1, Name: "abc"})
+	s.Delete(&User{Id: 2})
+
+	report, e := s.Verify()
+	if e != nil {
+		t.Fatal(e)
+	}
+	if !report.OK() || len(report.Tables) != 2 {
+		t.Fatalf("expect ok report, but got %+v", report.Tables[0].Problems)
+	}
+	r := report.Tables[1]
+	if r.Table != "jx.User" || r.Values != 4 || r.Frames != 6 || len(r.Orphans) != 2 {
+		t.Errorf("wrong report : %+v", r)
+	}
+
+	// break files, torn frame head is truncated by loading, so break it after loading
+	files, _ := s.Table(new(User)).Chunk.Files()
+	s.Close()
+	ioutil.WriteFile(path.Join(dir, "jx.User", "_pk", "auto.pk"), []byte{0, 0, 0, 0, 0, 0, 0, 1}, os.ModePerm)
+
+	s, e = NewStorage(dir)
+	if e != nil {
+		t.Fatal(e)
+	}
+	defer s.Close()
+	if e = s.Sync(new(User)); e != nil {
+		t.Fatal(e)
+	}
+	for file := range files {
+		f, _ := os.OpenFile(file, os.O_APPEND|os.O_WRONLY, os.ModePerm)
+		f.Write([]byte{0, 0, 0})
+		f.Close()
+	}
+	r, e = s.Table(new(User)).Verify()
+	if e != nil {
+		t.Fatal(e)
+	}
+	kinds := make(map[string]int)
+	for _, p := range r.Problems {
+		kinds[p.Kind]++
+	}
+	if r.OK() || kinds[ProblemTruncatedFrame] != 1 || kinds[ProblemAutoIncrement] != 1 {
+		t.Errorf("expect truncated frame and auto increment problems, but got %+v", kinds)
+	}
+}
+
+func TestRebuildIndex(t *testing.T) {
+	dir := t.TempDir()
+	s, e := NewStorage(dir)
+	if e != nil {
+		t.Fatal(e)
+	}
+	if e = s.Sync(new(User)); e != nil {
+		t.Fatal(e)
+	}
+	for i := 0; i < 5; i++ {
+		if e = s.Insert(&User{Name: randomString(8)}); e != nil {
+			t.Fatal(e)
+		}
+	}
+	s.Update(&User{Id: 1, Name: "abc"})
+	s.Update(&User{Id: 2, Name: "def"})
+	s.Delete(&User{Id: 2})
+	s.Delete(&User{Id: 5})
+	s.Close()
+
+	// lose pk files
+	os.Remove(path.Join(dir, "jx.User", "_pk", "pk.pk"))
+	os.Remove(path.Join(dir, "jx.User", "_pk", "auto.pk"))
+	s, e = NewStorage(dir)
+	if e != nil {
+		t.Fatal(e)
+	}
+	defer s.Close()
+	if e = s.Sync(new(User)); e == nil {
+		t.Fatal("expect missing pk error")
+	}
+	r, e := s.RebuildIndex(new(User))
+	if e != nil {
+		t.Fatal(e)
+	}
+	if r.Table != "jx.User" || r.Values != 3 || r.Frames != 7 || r.Deleted != 2 || len(r.Skipped) != 0 {
+		t.Errorf("wrong report : %+v", r)
+	}
+
+	u := &User{Id: 1}
+	if e = s.Get(u); e != nil || u.Name != "abc" {
+		t.Errorf("expect updated value, but got %v, %v", u, e)
+	}
+	for _, id := range []int64{2, 5} {
+		if e = s.Get(&User{Id: id}); e != Nil {
+			t.Errorf("expect deleted value %d, but got %v", id, e)
+		}
+	}
+	u = &User{Name: "ghi"}
+	if e = s.Insert(u); e != nil {
+		t.Fatal(e)
+	}
+	if u.Id != 6 {
+		t.Errorf("expect id %d, but got %d", 6, u.Id)
+	}
+	if report, _ := s.Verify(); !report.OK() {
+		t.Errorf("expect ok report, but got %+v", report.Tables[0].Problems)
+	}
+}
+
+func TestRebuildIndexReset(t *testing.T) {
+	dir := t.TempDir()
+	s, e := NewStorage(dir)
+	if e != nil {
+		t.Fatal(e)
+	}
+	if e = s.Sync(new(User)); e != nil {
+		t.Fatal(e)
+	}
+	for i := 0; i < 3; i++ {
+		if e = s.Insert(&User{Name: randomString(8)}); e != nil {
+			t.Fatal(e)
+		}
+	}
+	files, _ := s.Table(new(User)).Chunk.Files()
+	s.Close()
+
+	pkDir := path.Join(dir, "jx.User", "_pk")
+	pkFile := path.Join(pkDir, "pk.pk")
+	broken := []byte{0, 0, 0, 0, 0, 0, 0, 3, 'x', 'y', 'z'}
+	ioutil.WriteFile(pkFile, broken, os.ModePerm)
+	ioutil.WriteFile(pkFile+".broken", []byte("old"), os.ModePerm)
+
+	// broken chunk file is not fixed by resetting pk files, pk file is restored
+	var file string
+	for file = range files {
+	}
+	b, _ := ioutil.ReadFile(file)
+	ioutil.WriteFile(file, append([]byte{0xff}, b...), os.ModePerm)
+	s, e = NewStorage(dir)
+	if e != nil {
+		t.Fatal(e)
+	}
+	if _, e = s.RebuildIndex(new(User)); e == nil {
+		t.Fatal("expect broken chunk error")
+	}
+	if pk, _ := ioutil.ReadFile(pkFile); !bytes.Equal(pk, broken) {
+		t.Errorf("expect restored pk file, but got %q", pk)
+	}
+	if _, e = os.Stat(pkFile + ".broken.1"); !os.IsNotExist(e) {
+		t.Errorf("expect no broken pk file after restoring, but got %v", e)
+	}
+
+	// broken pk file is reset, existing broken file is not overwritten
+	ioutil.WriteFile(file, b, os.ModePerm)
+	if _, e = s.RebuildIndex(new(User)); e != nil {
+		t.Fatal(e)
+	}
+	defer s.Close()
+	if old, _ := ioutil.ReadFile(pkFile + ".broken"); string(old) != "old" {
+		t.Errorf("broken pk file is overwritten : %q", old)
+	}
+	if pk, _ := ioutil.ReadFile(pkFile + ".broken.1"); !bytes.Equal(pk, broken) {
+		t.Errorf("expect broken pk file, but got %q", pk)
+	}
+	for id := int64(1); id <= 3; id++ {
+		if e = s.Get(&User{Id: id}); e != nil {
+			t.Errorf("expect user %d, but got %v", id, e)
+		}
+	}
+}
+
+func TestTornTail(t *testing.T) {
+	dir := t.TempDir()
+	s, e := NewStorage(dir)
+	if e != nil {
+		t.Fatal(e)
+	}
+	if e = s.Sync(new(User)); e != nil {
+		t.Fatal(e)
+	}
+	if e = s.Insert(&User{Name: "a"}); e != nil {
+		t.Fatal(e)
+	}
+	files, _ := s.Table(new(User)).Chunk.Files()
+	s.Close()
+
+	// torn frame head and torn frame value of crash are truncated, new value is appended after good frames
+	tornValue := make([]byte, 16)
+	binary.BigEndian.PutUint64(tornValue, 100)
+	tornValue = append(tornValue, `{"Na`...)
+	for _, torn := range [][]byte{{1, 2, 3, 4, 5}, tornValue} {
+		for file := range files {
+			f, _ := os.OpenFile(file, os.O_APPEND|os.O_WRONLY, os.ModePerm)
+			f.Write(torn)
+			f.Close()
+		}
+		s, e = NewStorage(dir)
+		if e != nil {
+			t.Fatal(e)
+		}
+		if e = s.Sync(new(User)); e != nil {
+			t.Fatal(e)
+		}
+		if e = s.Insert(&User{Name: "b"}); e != nil {
+			t.Fatal(e)
+		}
+		s.Close()
+	}
+
+	s, e = NewStorage(dir)
+	if e != nil {
+		t.Fatal(e)
+	}
+	defer s.Close()
+	if e = s.Sync(new(User)); e != nil {
+		t.Fatal(e)
+	}
+	for id := int64(1); id <= 3; id++ {
+		if e = s.Get(&User{Id: id}); e != nil {
+			t.Errorf("expect user %d, but got %v", id, e)
+		}
+	}
+}
+
+func TestTolerantLoading(t *testing.T) {
+	dir := t.TempDir()
+	s, e := NewStorage(dir)
+	if e != nil {
+		t.Fatal(e)
+	}
+	if e = s.Sync(new(User)); e != nil {
+		t.Fatal(e)
+	}
+	for i := 0; i < 5; i++ {
+		if e = s.Insert(&User{Name: randomString(8)}); e != nil {
+			t.Fatal(e)
+		}
+	}
+	files, _ := s.Table(new(User)).Chunk.Files()
+	s.Close()
+
+	// break json of second frame, and append truncated frame head
+	var file string
+	for file = range files {
+	}
+	b, _ := ioutil.ReadFile(file)
+	b[16+int(b[7])+16] = 'x'
+	b = append(b, 0, 0, 0)
+	ioutil.WriteFile(file, b, os.ModePerm)
+
+	s, e = NewStorage(dir)
+	if e != nil {
+		t.Fatal(e)
+	}
+	if e = s.Sync(new(User)); e == nil {
+		t.Fatal("expect broken chunk error")
+	}
+
+	var quarantined []*col.Quarantine
+	s, e = NewStorage(dir, Options{Tolerant: true, OnQuarantine: func(q *col.Quarantine) {
+		quarantined = append(quarantined, q)
+	}})
+	if e != nil {
+		t.Fatal(e)
+	}
+	defer s.Close()
+	if e = s.Sync(new(User)); e != nil {
+		t.Fatal(e)
+	}
+	if len(quarantined) != 2 || quarantined[0].Size != int64(16+b[16+int(b[7])+7]) || !quarantined[1].Truncated {
+		t.Fatalf("wrong quarantined frames : %+v", quarantined)
+	}
+	// reloading chunk file does not report quarantined frame again
+	chunk := s.Table(new(User)).Chunk
+	if e = chunk.ReadCursorFile(chunk.GetCurrent(), true); e != nil {
+		t.Fatal(e)
+	}
+	if q := s.Table(new(User)).Quarantined(); len(q) != 2 || len(quarantined) != 2 {
+		t.Errorf("expect %d quarantined frames, but got %d", 2, len(q))
+	}
+	if bad, _ := ioutil.ReadFile(quarantined[0].Path); len(bad) != int(quarantined[0].Size) {
+		t.Errorf("wrong quarantined bytes : %q", bad)
+	}
+	if report, _ := ioutil.ReadFile(path.Join(dir, "jx.User", col.QuarantineDir, "report.jsonl")); bytes.Count(report, []byte("\n")) != 2 {
+		t.Errorf("wrong quarantine report : %s", report)
+	}
+
+	// good values are loaded, and new value is appended after good frames
+	if e = s.Get(&User{Id: 1}); e != nil {
+		t.Error(e)
+	}
+	if e = s.Get(&User{Id: 2}); e != Nil {
+		t.Errorf("expect %v, but got %v", Nil, e)
+	}
+	if e = s.Insert(&User{Name: "abc"}); e != nil {
+		t.Fatal(e)
+	}
+	report, _ := s.Verify()
+	if p := report.Tables[0].Problems; len(p) != 1 || p[0].Kind != ProblemCorruptFrame {
+		t.Errorf("expect only corrupt frame, but got %+v", p)
+	}
+}
+
+func TestCorruptFrameLength(t *testing.T) {
+	for _, length := range []int64{-1, 1 << 40} {
+		dir := t.TempDir()
+		s, e := NewStorage(dir)
+		if e != nil {
+			t.Fatal(e)
+		}
+		if e = s.Sync(new(User)); e != nil {
+			t.Fatal(e)
+		}
+		for i := 0; i < 5; i++ {
+			if e = s.Insert(&User{Name: randomString(8)}); e != nil {
+				t.Fatal(e)
+			}
+		}
+		files, _ := s.Table(new(User)).Chunk.Files()
+		s.Close()
+
+		// break length of second frame in the middle of file
+		var file string
+		for file = range files {
+		}
+		b, _ := ioutil.ReadFile(file)
+		second := 16 + int(b[7])
+		binary.BigEndian.PutUint64(b[second:], uint64(length))
+		ioutil.WriteFile(file, b, os.ModePerm)
+
+		s, e = NewStorage(dir)
+		if e != nil {
+			t.Fatal(e)
+		}
+		if e = s.Sync(new(User)); e == nil {
+			t.Fatalf("expect broken chunk error of length %d", length)
+		}
+
+		s, e = NewStorage(dir, Options{Tolerant: true})
+		if e != nil {
+			t.Fatal(e)
+		}
+		if e = s.Sync(new(User)); e != nil {
+			t.Fatal(e)
+		}
+		// frames after broken length are loaded, file is not truncated
+		q := s.Table(new(User)).Quarantined()
+		if len(q) != 1 || q[0].Truncated || q[0].Offset != int64(second) {
+			t.Fatalf("wrong quarantined frames : %+v", q)
+		}
+		for id := int64(1); id <= 5; id++ {
+			if e = s.Get(&User{Id: id}); id == 2 && !errors.Is(e, Nil) || id != 2 && e != nil {
+				t.Errorf("wrong user %d : %v", id, e)
+			}
+		}
+		if fi, _ := os.Stat(file); fi.Size() != int64(len(b)) {
+			t.Errorf("expect file size %d, but got %d", len(b), fi.Size())
+		}
+		s.Close()
+	}
+}
+
+func TestStats(t *testing.T) {
+	dir := t.TempDir()
+	s, e := NewStorage(dir)
+	if e != nil {
+		t.Fatal(e)
+	}
+	if e = s.Sync(new(User), new(Group)); e != nil {
+		t.Fatal(e)
+	}
+	for i := 0; i < 5; i++ {
+		if e = s.Insert(&User{Name: randomString(8)}); e != nil {
+			t.Fatal(e)
+		}
+	}
+	s.Update(&User{Id: 1, Name: "abc"})
+	s.Delete(&User{Id: 2})
+
+	stats, e := s.Stats()
+	if e != nil {
+		t.Fatal(e)
+	}
+	if len(stats.Tables) != 2 || stats.Records != 4 {
+		t.Fatalf("wrong storage stats : %+v", stats)
+	}
+	ts := stats.Tables[1]
+	if ts.Table != "jx.User" || ts.Records != 4 || ts.PkKeys != 4 || ts.PkLog != 7 || ts.AutoIncrement != 5 {
+		t.Errorf("wrong table stats : %+v", ts)
+	}
+	if ts.Chunks != 1 || ts.LoadedChunks != 1 || ts.ChunkFiles[0].Frames != 7 || ts.DeadBytes <= 0 || ts.Memory <= 0 {
+		t.Errorf("wrong chunk stats : %+v", ts.ChunkFiles[0])
+	}
+
+	// optimized files have no dead bytes
+	time.Sleep(10 * time.Millisecond)
+	if e = s.Optimize(); e != nil {
+		t.Fatal(e)
+	}
+	s.Close()
+	s, e = NewStorage(dir)
+	if e != nil {
+		t.Fatal(e)
+	}
+	defer s.Close()
+	if e = s.Sync(new(User)); e != nil {
+		t.Fatal(e)
+	}
+	ts, e = s.Table(new(User)).Stats()
+	if e != nil {
+		t.Fatal(e)
+	}
+	if ts.Records != 4 || ts.PkLog != 4 || ts.DeadBytes != 0 || ts.Bytes != ts.ChunkFiles[0].LiveBytes {
+		t.Errorf("wrong optimized stats : %+v", ts)
+	}
+}
+
+func TestMetrics(t *testing.T) {
+	dir := t.TempDir()
+	m := NewExpvarMetrics("jx_test_metrics")
+	s, e := NewStorage(dir, Options{Metrics: m})
+	if e != nil {
+		t.Fatal(e)
+	}
+	if e = s.Sync(new(User)); e != nil {
+		t.Fatal(e)
+	}
+	users := make([]*User, 2100)
+	for i := range users {
+		users[i] = &User{Name: randomString(8)}
+	}
+	if e = s.InsertMany(users); e != nil {
+		t.Fatal(e)
+	}
+	s.Get(&User{Id: 3000})
+	s.UpdateFields(&User{Id: 1}, "Nope")
+	s.Close()
+	for key, value := range map[string]string{
+		"jx.User.insert_many.count":    "1",
+		"jx.User.chunk.rollovers":      "2",
+		"jx.User.get.count":            "1",
+		"jx.User.get.errors":           "",
+		"jx.User.update_fields.errors": "1",
+	} {
+		if v := m.Map.Get(key); (v == nil && value != "") || (v != nil && v.String() != value) {
+			t.Errorf("expect %s %q, but got %v", key, value, v)
+		}
+	}
+
+	// log chunk loading
+	var buf bytes.Buffer
+	s, e = NewStorage(dir, Options{Logger: log.New(&buf, "", 0)})
+	if e != nil {
+		t.Fatal(e)
+	}
+	defer s.Close()
+	if e = s.Sync(new(User)); e != nil {
+		t.Fatal(e)
+	}
+	for _, id := range []int64{1, 1500} {
+		if e = s.Get(&User{Id: id}); e != nil {
+			t.Fatal(e)
+		}
+	}
+	if strings.Count(buf.String(), "jx.User load chunk") != 3 {
+		t.Errorf("expect 3 chunk loading logs, but got %q", buf.String())
+	}
+}
+
+func TestErrors(t *testing.T) {
+	dir := t.TempDir()
+	s, e := NewStorage(dir)
+	if e != nil {
+		t.Fatal(e)
+	}
+	if e = s.Sync(new(User), new(GroupUser)); e != nil {
+		t.Fatal(e)
+	}
+	var je *Error
+	if e = s.Get(new(Group)); !errors.Is(e, ErrNotSynced) || !errors.As(e, &je) || je.Table != "jx.Group" {
+		t.Errorf("expect not synced error, but got %v", e)
+	}
+	// not found and conflict are sentinels as they are
+	if e = s.Delete(&User{Id: 1}); e != Nil {
+		t.Errorf("expect not found error, but got %v", e)
+	}
+	if e = s.DeleteMany([]*User{{Id: 1}}); e == nil || e.(*BatchError).Errors[0] != Nil {
+		t.Errorf("expect not found error in batch, but got %v", e)
+	}
+	s.Insert(&GroupUser{GroupName: "a", UserId: 1})
+	if e = s.Insert(&GroupUser{GroupName: "a", UserId: 1}); e != Conflict {
+		t.Fatalf("expect conflict error, but got %v", e)
+	}
+	e = s.Insert(&GroupUser{UserId: 1})
+	if !errors.Is(e, Wrong) || !errors.As(e, &je) || je.Table != "jx.GroupUser" {
+		t.Fatalf("expect wrong error, but got %v", e)
+	}
+	if pk, ok := je.Pk.([]interface{}); !ok || len(pk) != 2 || pk[0] != "" {
+		t.Errorf("expect composite pk, but got %v", je.Pk)
+	}
+
+	// broken chunk file is corrupt
+	if e = s.Insert(&User{Name: "abc"}); e != nil {
+		t.Fatal(e)
+	}
+	files, _ := s.Table(new(User)).Chunk.Files()
+	s.Close()
+	if e = s.Get(&User{Id: 1}); !errors.Is(e, ErrClosed) {
+		t.Errorf("expect closed error, but got %v", e)
+	}
+	for file := range files {
+		ioutil.WriteFile(file, []byte{0, 0, 0, 0, 0, 0, 0, 3, 0, 0, 0, 0, 0, 0, 0, 1, 'b', 'a', 'd'}, os.ModePerm)
+	}
+	s, e = NewStorage(dir)
+	if e != nil {
+		t.Fatal(e)
+	}
+	e = s.Sync(new(User))
+	if !errors.Is(e, ErrCorrupt) || !errors.As(e, &je) || je.Table != "jx.User" || je.Path == "" {
+		t.Errorf("expect corrupt error, but got %v", e)
+	}
+}
+
+// context canceled after n checks.
+type countdownContext struct {
+	context.Context
+	n int
+}
+
+func (c *countdownContext) Err() error {
+	if c.n--; c.n < 0 {
+		return context.Canceled
+	}
+	return nil
+}
+
+func TestContext(t *testing.T) {
+	dir := t.TempDir()
+	s, e := NewStorage(dir)
+	if e != nil {
+		t.Fatal(e)
+	}
+	if e = s.Sync(new(User)); e != nil {
+		t.Fatal(e)
+	}
+	users := make([]*User, 100)
+	for i := range users {
+		users[i] = &User{Name: randomString(8)}
+	}
+	if e = s.InsertMany(users); e != nil {
+		t.Fatal(e)
+	}
+	s.Delete(&User{Id: 1})
+
+	// canceled batch writes nothing
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if e = s.InsertManyContext(ctx, []*User{{Name: "abc"}}); !errors.Is(e, context.Canceled) {
+		t.Errorf("expect canceled, but got %v", e)
+	}
+	if r, e := s.VerifyContext(ctx); !errors.Is(e, context.Canceled) || r != nil {
+		t.Errorf("expect canceled verify, but got %v", e)
+	}
+
+	// scan stops after canceling
+	ctx, cancel = context.WithCancel(context.Background())
+	var count int
+	e = s.ScanContext(ctx, new(User), func(v interface{}) bool {
+		if count++; count == 10 {
+			cancel()
+		}
+		return true
+	})
+	if !errors.Is(e, context.Canceled) || count != 10 {
+		t.Errorf("expect canceled scan after 10 values, but got %v, %d", e, count)
+	}
+
+	// optimizing canceled in writing pk leaves no opm file
+	if e = s.OptimizeContext(&countdownContext{Context: context.Background(), n: 10}); !errors.Is(e, context.Canceled) {
+		t.Errorf("expect canceled optimizing, but got %v", e)
+	}
+	for _, pattern := range []string{"*/*.opm", "*/*.opm.tmp"} {
+		if files, _ := filepath.Glob(path.Join(dir, "jx.User", pattern)); len(files) > 0 {
+			t.Errorf("expect no optimized files, but got %v", files)
+		}
+	}
+	s.Close()
+
+	s, e = NewStorage(dir)
+	if e != nil {
+		t.Fatal(e)
+	}
+	defer s.Close()
+	// syncing canceled after reading pk file keeps no table
+	if e = s.SyncContext(&countdownContext{Context: context.Background(), n: 2}, new(User)); !errors.Is(e, context.Canceled) || s.Table(new(User)) != nil {
+		t.Errorf("expect canceled syncing, but got %v", e)
+	}
+	if e = s.Sync(new(User)); e != nil {
+		t.Fatal(e)
+	}
+	var buf bytes.Buffer
+	if e = s.BackupContext(&countdownContext{Context: context.Background(), n: 2}, &buf); !errors.Is(e, context.Canceled) {
+		t.Errorf("expect canceled backup, but got %v", e)
+	}
+	if _, e = VerifyBackup(&buf); e == nil {
+		t.Error("expect broken archive of canceled backup")
+	}
+	count = 0
+	if e = s.Scan(new(User), func(v interface{}) bool {
+		count++
+		return true
+	}); e != nil || count != 99 {
+		t.Errorf("expect %d users, but got %d, %v", 99, count, e)
+	}
+	u := &User{Id: 100}
+	if e = s.Get(u); e != nil || u.Name != users[99].Name {
+		t.Errorf("expect user %q, but got %q, %v", users[99].Name, u.Name, e)
+	}
+}
+
+func TestCollection(t *testing.T) {
+	s, e := NewStorage(t.TempDir())
+	if e != nil {
+		t.Fatal(e)
+	}
+	defer s.Close()
+	if _, e = Collection[User](s); !errors.Is(e, ErrNotSynced) {
+		t.Errorf("expect not synced, but got %v", e)
+	}
+	if e = s.Sync(new(User), new(GroupUser)); e != nil {
+		t.Fatal(e)
+	}
+	if _, e = CollectionOf[User, string](s); e == nil {
+		t.Error("expect wrong pk type error")
+	}
+
+	users, e := CollectionOf[User, int64](s)
+	if e != nil {
+		t.Fatal(e)
+	}
+	for i := 0; i < 5; i++ {
+		if e = users.Insert(&User{Name: randomString(8), Age: i}); e != nil {
+			t.Fatal(e)
+		}
+	}
+	u, e := users.Get(3)
+	if e != nil || u.Id != 3 || u.Age != 2 {
+		t.Errorf("wrong user : %+v, %v", u, e)
+	}
+	u.Name = "abc"
+	if e = users.Update(&u); e != nil {
+		t.Fatal(e)
+	}
+	if u, e = users.Modify(3, func(v *User) error {
+		v.Age++
+		return nil
+	}); e != nil || u.Name != "abc" || u.Age != 3 {
+		t.Errorf("wrong modified user : %+v, %v", u, e)
+	}
+	if e = users.Delete(1); e != nil {
+		t.Fatal(e)
+	}
+	if _, e = users.Get(1); !errors.Is(e, Nil) {
+		t.Errorf("expect not found, but got %v", e)
+	}
+	found, e := users.Find(func(v *User) bool {
+		return v.Age > 3
+	})
+	if e != nil || len(found) != 1 || found[0].Id != 5 {
+		t.Errorf("wrong found users : %+v, %v", found, e)
+	}
+
+	// composite pk
+	members, e := Collection[GroupUser](s)
+	if e != nil {
+		t.Fatal(e)
+	}
+	for _, m := range []*GroupUser{{GroupName: "a", UserId: 1}, {GroupName: "a", UserId: 2}, {GroupName: "b", UserId: 1, Role: "admin"}} {
+		if e = members.Insert(m); e != nil {
+			t.Fatal(e)
+		}
+	}
+	// int of interface pk is converted to pk field type
+	for _, pk := range [][]interface{}{{"b", int64(1)}, {"b", 1}} {
+		if m, e := members.Get(pk); e != nil || m.Role != "admin" {
+			t.Errorf("wrong member : %+v, %v", m, e)
+		}
+	}
+	for _, pk := range []interface{}{"b", []interface{}{"b", "1"}, []interface{}{"b", 1.5}} {
+		if _, e = members.Get(pk); !errors.Is(e, Wrong) {
+			t.Errorf("expect wrong pk, but got %v", e)
+		}
+	}
+	anyUsers, e := Collection[User](s)
+	if e != nil {
+		t.Fatal(e)
+	}
+	if u, e := anyUsers.Get(2); e != nil || u.Id != 2 {
+		t.Errorf("wrong user : %+v, %v", u, e)
+	}
+
+	// iterate in pk order, stop by breaking
+	var ids []int64
+	users.All()(func(v User, e error) bool {
+		if e != nil {
+			t.Fatal(e)
+		}
+		ids = append(ids, v.Id)
+		return len(ids) < 3
+	})
+	if len(ids) != 3 || ids[0] != 2 || ids[2] != 4 {
+		t.Errorf("wrong iterated users : %v", ids)
+	}
+	var roles []string
+	members.All("b")(func(v GroupUser, e error) bool {
+		roles = append(roles, v.Role)
+		return true
+	})
+	if len(roles) != 1 || roles[0] != "admin" {
+		t.Errorf("wrong iterated members : %v", roles)
+	}
+
+	// pk of other type is not converted
+	if e = s.Sync(new(Group), new(Token)); e != nil {
+		t.Fatal(e)
+	}
+	if e = s.Insert(&Group{Name: "A"}); e != nil {
+		t.Fatal(e)
+	}
+	groups, e := Collection[Group](s)
+	if e != nil {
+		t.Fatal(e)
+	}
+	if _, e = groups.Get(65); !errors.Is(e, Wrong) {
+		t.Errorf("expect wrong pk, but got %v", e)
+	}
+	if _, e = groups.Modify(65, func(v *Group) error { return nil }); !errors.Is(e, Wrong) {
+		t.Errorf("expect wrong pk, but got %v", e)
+	}
+	if e = groups.Delete(65); !errors.Is(e, Wrong) {
+		t.Errorf("expect wrong pk, but got %v", e)
+	}
+	tokens, e := Collection[Token](s)
+	if e != nil {
+		t.Fatal(e)
+	}
+	if _, e = tokens.Get([]interface{}{time.Now(), []byte{1, 2}}); !errors.Is(e, Wrong) {
+		t.Errorf("expect wrong pk, but got %v", e)
+	}
+	if found, e := members.Find(nil, "a"); e != nil || len(found) != 2 {
+		t.Errorf("wrong members : %+v, %v", found, e)
+	}
+}
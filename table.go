@@ -1,113 +1,667 @@
 package jx
 
 import (
+	"context"
 	"errors"
+	"fmt"
 	"github.com/Unknwon/com"
 	"github.com/fuxiaohei/jx/col"
 	"os"
 	"path"
 	"reflect"
+	"sync"
+	"time"
 )
 
 var (
 	Nil      = errors.New("nil")
 	Conflict = errors.New("conflict")
 	Wrong    = errors.New("wrong")
+
+	// ErrStaleVersion means saved version is different from updating value,
+	// the value is changed by others.
+	ErrStaleVersion = errors.New("stale version")
 )
 
+// BatchError reports failed items of batch operation,
+// by the index in batch values.
+type BatchError struct {
+	Errors map[int]error
+}
+
+// error message with failed count.
+func (b *BatchError) Error() string {
+	return fmt.Sprintf("batch failed items : %d", len(b.Errors))
+}
+
 type Table struct {
 	directory string
 	Object    *Object
 
 	Chunk *col.Chunk
 	Pk    *col.PK
+
+	// pk generator, set by storage if object pk is generated.
+	Generator Generator
+
+	// default time to live of values, 0 is never expired.
+	ttl time.Duration
+
+	options Options
+
+	// watchers of value changes, guarded by lock.
+	watchers map[*Watcher]bool
+
+	// closed table returns closed error for operations.
+	closed bool
+
+	// write operations hold lock, read operations hold read lock.
+	lock sync.RWMutex
+}
+
+// set default time to live of values.
+// values without expire field are expired after ttl since inserting or updating.
+// 0 means never expired.
+func (t *Table) SetTTL(ttl time.Duration) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	t.ttl = ttl
 }
 
 // insert value to table.
 // save value to chunk and pk.
 func (t *Table) Insert(v interface{}) (e error) {
-	// set pk value, auto-increment or unique.
-	var pk interface{}
-	pk, e = t.Pk.SetPk(v, t.Object.Pk)
-	if e != nil {
-		// use table error, not pk error
-		if e == col.PKConflict {
-			e = Conflict
+	defer t.observe("insert", time.Now(), &e)
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	if e = t.checkClosed(); e != nil {
+		return
+	}
+	e = t.insert(v, false)
+	return
+}
+
+// insert many values to table.
+// values are written in one buffer for each chunk file and pk file.
+// failed values are reported by *BatchError, others are inserted.
+func (t *Table) InsertMany(values []interface{}) (e error) {
+	return t.InsertManyContext(context.Background(), values)
+}
+
+// insert many values to table, unless ctx is canceled before writing.
+func (t *Table) InsertManyContext(ctx context.Context, values []interface{}) (e error) {
+	defer t.observe("insert_many", time.Now(), &e)
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	if e = t.checkClosed(); e != nil {
+		return
+	}
+	if e = ctx.Err(); e != nil {
+		return
+	}
+
+	errs := make(map[int]error)
+	keys := make(map[string]bool)
+	now := time.Now()
+	var items, pks, inserted []interface{}
+	var exps []int64
+	for i, v := range values {
+		if e = beforeInsert(v); e != nil {
+			errs[i] = e
+			continue
 		}
-		if e == col.PkEmpty {
-			e = Wrong
+		if e = t.generatePk(v); e != nil {
+			errs[i] = e
+			continue
 		}
-		return
+		if e = t.purgeExpired(v, false, now); e != nil {
+			return
+		}
+		pk, e := t.Pk.SetPk(v, t.Object.Pks...)
+		if e != nil {
+			errs[i] = t.pkError(t.Object.PkValue(v), e)
+			continue
+		}
+		// pk conflicts in batch values
+		key, _ := col.EncodeKey(pk)
+		if keys[string(key)] {
+			errs[i] = Conflict
+			continue
+		}
+		keys[string(key)] = true
+		t.prepareInsert(v, now)
+		items = append(items, t.copyValue(v))
+		inserted = append(inserted, v)
+		pks = append(pks, pk)
+		exps = append(exps, t.expireOf(v, now))
 	}
 
-	// write to chunk
-	uid, cursor, e := t.Chunk.Write(v)
+	if len(items) > 0 {
+		uids, cursors, e := t.Chunk.WriteMany(items)
+		if e != nil {
+			return e
+		}
+		if e = t.Pk.WriteMany(pks, cursors, uids, exps); e != nil {
+			return e
+		}
+		for _, v := range inserted {
+			afterInsert(v)
+			t.notify(ChangeInsert, nil, v)
+		}
+	}
+	if len(errs) > 0 {
+		return &BatchError{Errors: errs}
+	}
+	return nil
+}
+
+// use table error, not pk error.
+// pk conflict is Conflict, empty or invalid pk is wrong error with the pk.
+func (t *Table) pkError(pk interface{}, e error) error {
+	if e == col.PKConflict {
+		return Conflict
+	}
+	if e == col.PkEmpty || e == col.PkInvalid {
+		return t.error(Wrong, pk, e)
+	}
+	return e
+}
+
+// generate pk value by generator.
+// pk set already is kept, so merged values keep their pk.
+func (t *Table) generatePk(v interface{}) (e error) {
+	if t.Object.PkGen == "" {
+		return
+	}
+	if t.Generator == nil {
+		e = fmt.Errorf("pk generator is not registered : %s", t.Object.PkGen)
+		return
+	}
+	field := reflect.ValueOf(v).Elem().FieldByName(t.Object.Pk)
+	if !field.IsZero() {
+		return
+	}
+	pk, e := t.Generator.Generate()
 	if e != nil {
 		return
 	}
-
-	// write to pk
-	e = t.Pk.Write(pk, cursor, uid, 0)
+	e = setGenerated(field, pk)
 	return
 }
 
 // delete value in table.
 // delete pk and data in chunk together.
+// if not found, return error Nil.
+// if version field is not zero, return ErrStaleVersion when saved version is different.
 func (t *Table) Delete(v interface{}) (e error) {
+	defer t.observe("delete", time.Now(), &e)
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	if e = t.checkClosed(); e != nil {
+		return
+	}
+
 	// get pkValue for chunk deleting
-	pk := reflect.ValueOf(v).Elem().FieldByName(t.Object.Pk).Interface()
-	pkValue, e := t.Pk.Get(pk)
-	if e != nil || pkValue == nil {
+	pk := t.Object.PkValue(v)
+	pkValue, e := t.getPk(pk)
+	if e != nil {
 		return
 	}
-	// delete in pk first.
-	if e = t.Pk.Delete(pk); e != nil {
+	if pkValue == nil {
+		e = Nil
 		return
 	}
-
-	// get value, if not found, no need to delete.
-	value, e := t.Chunk.Get(pkValue)
-	if e != nil || value == nil {
+	if e = t.checkDeleteVersion(pkValue, v); e != nil {
 		return
 	}
-	e = t.Chunk.Delete(pkValue)
+	if e = beforeDelete(v); e != nil {
+		return
+	}
+	var saved interface{}
+	if t.watching() {
+		if saved, e = t.value(pkValue); e != nil {
+			return
+		}
+	}
+	if e = t.delete(pk, pkValue); e != nil {
+		return
+	}
+	afterDelete(v)
+	t.notify(ChangeDelete, saved, nil)
 	return
 }
 
 // update value in table.
 // update data and pk together.
+// if not found, return error Nil.
+// if saved version is different, return ErrStaleVersion, otherwise version is increased.
 func (t *Table) Update(v interface{}) (e error) {
+	defer t.observe("update", time.Now(), &e)
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	if e = t.checkClosed(); e != nil {
+		return
+	}
+
 	// get pkValue for chunk updating
-	pk := reflect.ValueOf(v).Elem().FieldByName(t.Object.Pk).Interface()
-	pkValue, e := t.Pk.Get(pk)
-	if e != nil || pkValue == nil {
+	pk := t.Object.PkValue(v)
+	pkValue, e := t.getPk(pk)
+	if e != nil {
+		return
+	}
+	if pkValue == nil {
+		e = Nil
 		return
 	}
+	e = t.update(pk, pkValue, v)
+	return
+}
 
-	// write to data chunk
-	e = t.Chunk.Update(v, pkValue)
+// update named fields of value in table.
+// only the fields are merged to saved value, others are kept.
+// v is filled by merged value.
+// if not found, return error Nil.
+func (t *Table) UpdateFields(v interface{}, fields ...string) (e error) {
+	defer t.observe("update_fields", time.Now(), &e)
+	if e = t.checkFields(fields); e != nil {
+		return
+	}
+
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	if e = t.checkClosed(); e != nil {
+		return
+	}
+
+	pk := t.Object.PkValue(v)
+	pkValue, value, e := t.load(pk)
 	if e != nil {
 		return
 	}
+	if value == nil {
+		e = Nil
+		return
+	}
+	merged := reflect.ValueOf(t.copyValue(value)).Elem()
+	rv := reflect.ValueOf(v).Elem()
+	if t.Object.Version != "" {
+		// check version of passed value
+		fields = append(fields, t.Object.Version)
+	}
+	for _, field := range fields {
+		merged.FieldByName(field).Set(rv.FieldByName(field))
+	}
+	if e = t.update(pk, pkValue, merged.Addr().Interface()); e != nil {
+		return
+	}
+	rv.Set(merged)
+	return
+}
 
-	// write to pk
-	e = t.Pk.Update(pk, pkValue)
+// update fields of value by pk in table.
+// map values need assignable types, or exact numbers converted to number fields, nil means zero value.
+// composite pk needs []interface{} of all pk fields.
+// v is filled by updated value.
+// if not found, return error Nil.
+func (t *Table) UpdateMap(v interface{}, pk interface{}, values map[string]interface{}) (e error) {
+	defer t.observe("update_map", time.Now(), &e)
+	fields := make([]string, 0, len(values))
+	for field := range values {
+		fields = append(fields, field)
+	}
+	if e = t.checkFields(fields); e != nil {
+		return
+	}
+	if pk, e = t.Object.ConvertPk(pk); e != nil {
+		return
+	}
+
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	if e = t.checkClosed(); e != nil {
+		return
+	}
+
+	pkValue, value, e := t.load(pk)
+	if e != nil {
+		return
+	}
+	if value == nil {
+		e = Nil
+		return
+	}
+	merged := reflect.ValueOf(t.copyValue(value)).Elem()
+	for field, fv := range values {
+		f := merged.FieldByName(field)
+		if fv == nil {
+			f.Set(reflect.Zero(f.Type()))
+			continue
+		}
+		rv, ok := convertValue(reflect.ValueOf(fv), f.Type())
+		if !ok {
+			e = fmt.Errorf("value %s can't set to field %s : %s", reflect.TypeOf(fv).String(), field, t.Object.DataType.String())
+			return
+		}
+		f.Set(rv)
+	}
+	if e = t.update(pk, pkValue, merged.Addr().Interface()); e != nil {
+		return
+	}
+	reflect.ValueOf(v).Elem().Set(merged)
 	return
 }
 
-// get value by value pk field.
-// it not found, return error Nil.
-func (t *Table) Get(v interface{}) (e error) {
-	pk := reflect.ValueOf(v).Elem().FieldByName(t.Object.Pk).Interface()
-	pkValue, e := t.Pk.Get(pk)
+// modify value by pk in table atomically.
+// fn gets a copy of saved value to modify, under table write lock.
+// if fn returns error, nothing is saved.
+// v is filled by modified value.
+// if not found, return error Nil.
+func (t *Table) Modify(v interface{}, pk interface{}, fn func(v interface{}) error) (e error) {
+	defer t.observe("modify", time.Now(), &e)
+	if pk, e = t.Object.ConvertPk(pk); e != nil {
+		return
+	}
+
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	if e = t.checkClosed(); e != nil {
+		return
+	}
+
+	pkValue, value, e := t.load(pk)
 	if e != nil {
 		return
 	}
-	if pkValue == nil {
+	if value == nil {
 		e = Nil
 		return
 	}
-	value, e := t.Chunk.Get(pkValue)
+	modified := t.copyValue(value)
+	if e = fn(modified); e != nil {
+		return
+	}
+	if e = t.update(pk, pkValue, modified); e != nil {
+		return
+	}
+	reflect.ValueOf(v).Elem().Set(reflect.ValueOf(modified).Elem())
+	return
+}
+
+// increase number field of value by pk in table atomically.
+// the field is int, uint or float kind, delta can be negative.
+// v is filled by increased value.
+// if not found, return error Nil.
+func (t *Table) Incr(v interface{}, pk interface{}, field string, delta int64) (e error) {
+	if e = t.checkFields([]string{field}); e != nil {
+		return
+	}
+	sf, _ := t.Object.DataType.FieldByName(field)
+	switch sf.Type.Kind() {
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64,
+		reflect.Float32, reflect.Float64:
+	default:
+		return fmt.Errorf("field %s need number : %s", field, t.Object.DataType.String())
+	}
+
+	e = t.Modify(v, pk, func(value interface{}) error {
+		f := reflect.ValueOf(value).Elem().FieldByName(field)
+		switch f.Kind() {
+		case reflect.Float32, reflect.Float64:
+			f.SetFloat(f.Float() + float64(delta))
+		case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+			if delta < 0 && uint64(-delta) > f.Uint() {
+				return fmt.Errorf("field %s overflow : %s", field, t.Object.DataType.String())
+			}
+			n := f.Uint() + uint64(delta)
+			if f.OverflowUint(n) {
+				return fmt.Errorf("field %s overflow : %s", field, t.Object.DataType.String())
+			}
+			f.SetUint(n)
+		default:
+			n := f.Int() + delta
+			if f.OverflowInt(n) || (delta > 0 && n < f.Int()) || (delta < 0 && n > f.Int()) {
+				return fmt.Errorf("field %s overflow : %s", field, t.Object.DataType.String())
+			}
+			f.SetInt(n)
+		}
+		return nil
+	})
+	return
+}
+
+// check fields to update are in struct and not pk fields.
+// unexported fields and fields ignored by json are not saved, they can't be updated.
+func (t *Table) checkFields(fields []string) (e error) {
+	for _, field := range fields {
+		sf, ok := t.Object.DataType.FieldByName(field)
+		if !ok {
+			return fmt.Errorf("no field %s : %s", field, t.Object.DataType.String())
+		}
+		if sf.PkgPath != "" || sf.Tag.Get("json") == "-" {
+			return fmt.Errorf("field %s is not saved : %s", field, t.Object.DataType.String())
+		}
+		for _, pk := range t.Object.Pks {
+			if pk == field {
+				return fmt.Errorf("pk field %s can't be updated : %s", field, t.Object.DataType.String())
+			}
+		}
+	}
+	return
+}
+
+// put value to table.
+// insert value if its pk is not found, otherwise update it.
+// empty auto or generated pk is always inserted with new pk.
+func (t *Table) Put(v interface{}) (e error) {
+	defer t.observe("put", time.Now(), &e)
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	if e = t.checkClosed(); e != nil {
+		return
+	}
+
+	if t.Object.PkAuto || t.Object.PkGen != "" {
+		if reflect.ValueOf(v).Elem().FieldByName(t.Object.Pk).IsZero() {
+			return t.insert(v, false)
+		}
+	}
+	pk := t.Object.PkValue(v)
+	pkValue, e := t.getPk(pk)
+	if e != nil {
+		return
+	}
+	if pkValue == nil {
+		return t.insert(v, false)
+	}
+	return t.update(pk, pkValue, v)
+}
+
+// update many values in table.
+// values are written in one buffer for each chunk file and pk file.
+// failed values are reported by *BatchError, others are updated.
+// values not found are failed by error Nil, same pk in batch values by Conflict.
+func (t *Table) UpdateMany(values []interface{}) (e error) {
+	return t.UpdateManyContext(context.Background(), values)
+}
+
+// update many values in table, unless ctx is canceled before writing.
+func (t *Table) UpdateManyContext(ctx context.Context, values []interface{}) (e error) {
+	defer t.observe("update_many", time.Now(), &e)
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	if e = t.checkClosed(); e != nil {
+		return
+	}
+	if e = ctx.Err(); e != nil {
+		return
+	}
+
+	errs := make(map[int]error)
+	keys := make(map[string]bool)
+	now := time.Now()
+	var items, pks, updated, saves []interface{}
+	var pkValues []*col.PkValue
+	for i, v := range values {
+		pk := t.Object.PkValue(v)
+		pkValue, e := t.getPk(pk)
+		if e != nil {
+			errs[i] = t.pkError(pk, e)
+			continue
+		}
+		if pkValue == nil {
+			errs[i] = Nil
+			continue
+		}
+		if keys[string(pkValue.Key)] {
+			errs[i] = Conflict
+			continue
+		}
+		keys[string(pkValue.Key)] = true
+		if e = beforeUpdate(v); e != nil {
+			errs[i] = e
+			continue
+		}
+		if e = t.checkVersion(pkValue, v); e != nil {
+			errs[i] = e
+			continue
+		}
+		saved, e := t.value(pkValue)
+		if e != nil {
+			errs[i] = e
+			continue
+		}
+		item := t.copyValue(v)
+		t.setVersion(item, t.getVersion(v)+1)
+		t.setTimes(item, saved, now)
+		items = append(items, item)
+		updated = append(updated, v)
+		saves = append(saves, saved)
+		pks = append(pks, pk)
+		pkValues = append(pkValues, pkValue)
+	}
+
+	if len(items) > 0 {
+		if e = t.Chunk.UpdateMany(items, pkValues); e != nil {
+			return
+		}
+		// passed values get new version and times
+		for i, v := range updated {
+			reflect.ValueOf(v).Elem().Set(reflect.ValueOf(items[i]).Elem())
+		}
+		cursors := make([]int, len(pkValues))
+		uids := make([]int64, len(pkValues))
+		exps := make([]int64, len(pkValues))
+		for i, pkValue := range pkValues {
+			cursors[i], uids[i] = pkValue.Cursor, pkValue.Uid
+			exps[i] = t.expireOf(items[i], now)
+		}
+		if e = t.Pk.WriteMany(pks, cursors, uids, exps); e != nil {
+			return
+		}
+		for i, v := range updated {
+			afterUpdate(v)
+			t.notify(ChangeUpdate, saves[i], v)
+		}
+	}
+	if len(errs) > 0 {
+		return &BatchError{Errors: errs}
+	}
+	return nil
+}
+
+// delete many values in table.
+// deleted pks are written in one appending.
+// failed values are reported by *BatchError, such as values not found by error Nil,
+// or duplicated pk by Conflict, others are deleted.
+func (t *Table) DeleteMany(values []interface{}) (e error) {
+	return t.DeleteManyContext(context.Background(), values)
+}
+
+// delete many values in table, unless ctx is canceled before writing.
+func (t *Table) DeleteManyContext(ctx context.Context, values []interface{}) (e error) {
+	defer t.observe("delete_many", time.Now(), &e)
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	if e = t.checkClosed(); e != nil {
+		return
+	}
+	if e = ctx.Err(); e != nil {
+		return
+	}
+
+	errs := make(map[int]error)
+	keys := make(map[string]bool)
+	var pks, deleted, saves []interface{}
+	var pkValues []*col.PkValue
+	for i, v := range values {
+		pk := t.Object.PkValue(v)
+		pkValue, e := t.getPk(pk)
+		if e != nil {
+			errs[i] = t.pkError(pk, e)
+			continue
+		}
+		if pkValue == nil {
+			errs[i] = Nil
+			continue
+		}
+		if keys[string(pkValue.Key)] {
+			errs[i] = Conflict
+			continue
+		}
+		keys[string(pkValue.Key)] = true
+		if e = t.checkDeleteVersion(pkValue, v); e != nil {
+			errs[i] = e
+			continue
+		}
+		if e = beforeDelete(v); e != nil {
+			errs[i] = e
+			continue
+		}
+		var saved interface{}
+		if t.watching() {
+			if saved, e = t.value(pkValue); e != nil {
+				errs[i] = e
+				continue
+			}
+		}
+		pks = append(pks, pk)
+		deleted = append(deleted, v)
+		saves = append(saves, saved)
+		pkValues = append(pkValues, pkValue)
+	}
+
+	if len(pks) > 0 {
+		// delete in pk first.
+		if e = t.Pk.DeleteMany(pks); e != nil {
+			return
+		}
+		if e = t.Chunk.DeleteMany(pkValues); e != nil {
+			return
+		}
+		for i, v := range deleted {
+			afterDelete(v)
+			t.notify(ChangeDelete, saves[i], nil)
+		}
+	}
+	if len(errs) > 0 {
+		return &BatchError{Errors: errs}
+	}
+	return nil
+}
+
+// get value by value pk field.
+// it not found, return error Nil.
+func (t *Table) Get(v interface{}) (e error) {
+	defer t.observe("get", time.Now(), &e)
+	t.lock.RLock()
+	defer t.lock.RUnlock()
+	if e = t.checkClosed(); e != nil {
+		return
+	}
+
+	pk := t.Object.PkValue(v)
+	_, value, e := t.load(pk)
 	if e != nil {
 		return
 	}
@@ -117,21 +671,362 @@ func (t *Table) Get(v interface{}) (e error) {
 	}
 	// assign to passed value
 	reflect.ValueOf(v).Elem().Set(reflect.ValueOf(value).Elem())
+	afterLoad(v)
+	return
+}
+
+// scan values in pk order.
+// prefix values match the leading fields of composite pk.
+// fn gets a copy of each value, returns false to stop scanning.
+// values changed in scanning may be seen or not.
+func (t *Table) Scan(fn func(v interface{}) bool, prefix ...interface{}) (e error) {
+	return t.ScanContext(context.Background(), fn, prefix...)
+}
+
+// scan values in pk order until ctx is canceled, and return ctx error.
+func (t *Table) ScanContext(ctx context.Context, fn func(v interface{}) bool, prefix ...interface{}) (e error) {
+	defer t.observe("scan", time.Now(), &e)
+	fields, e := t.Object.convertPkFields(prefix)
+	if e != nil {
+		return
+	}
+	key, e := col.EncodeKeyFields(fields)
+	if e != nil {
+		return
+	}
+
+	t.lock.RLock()
+	pkValues := t.Pk.Prefix(key)
+	t.lock.RUnlock()
+
+	for _, pkValue := range pkValues {
+		if e = ctx.Err(); e != nil {
+			return
+		}
+		value, e := t.scanValue(pkValue.Key)
+		if e != nil {
+			return e
+		}
+		if value == nil {
+			continue
+		}
+		if !fn(value) {
+			return nil
+		}
+	}
+	return
+}
+
+// get copy of value by key in scanning.
+// not hold lock when calling scanning func.
+func (t *Table) scanValue(key []byte) (v interface{}, e error) {
+	t.lock.RLock()
+	defer t.lock.RUnlock()
+	if e = t.checkClosed(); e != nil {
+		return
+	}
+
+	pkValue := t.Pk.GetKey(key)
+	if pkValue == nil || pkValue.Expired(time.Now().UnixNano()) {
+		return
+	}
+	value, e := t.value(pkValue)
+	if e != nil || value == nil {
+		return
+	}
+	v = t.copyValue(value)
+	afterLoad(v)
+	return
+}
+
+// insert value to chunk and pk.
+// it sets pk field of value if auto-increment or generated.
+// if keepPk, as importing, explicit auto-increment pk, version and time fields are kept.
+func (t *Table) insert(v interface{}, keepPk bool) (e error) {
+	if e = beforeInsert(v); e != nil {
+		return
+	}
+
+	// generate pk if empty
+	if e = t.generatePk(v); e != nil {
+		return
+	}
+
+	now := time.Now()
+	if e = t.purgeExpired(v, keepPk, now); e != nil {
+		return
+	}
+
+	// set pk value, auto-increment or unique.
+	var pk interface{}
+	if keepPk && t.Object.PkAuto {
+		pk, e = t.Pk.KeepAuto(v, t.Object.Pk)
+	} else {
+		pk, e = t.Pk.SetPk(v, t.Object.Pks...)
+	}
+	if e != nil {
+		e = t.pkError(t.Object.PkValue(v), e)
+		return
+	}
+	if keepPk {
+		t.prepareImport(v, now)
+	} else {
+		t.prepareInsert(v, now)
+	}
+
+	// write to chunk
+	uid, cursor, e := t.Chunk.Write(t.copyValue(v))
+	if e != nil {
+		return
+	}
+
+	// write to pk
+	if e = t.Pk.Write(pk, cursor, uid, t.expireOf(v, now)); e != nil {
+		return
+	}
+	afterInsert(v)
+	t.notify(ChangeInsert, nil, v)
+	return
+}
+
+// delete expired value with same pk before inserting.
+// new auto-increment pk is never used, unless keepPk.
+func (t *Table) purgeExpired(v interface{}, keepPk bool, now time.Time) (e error) {
+	if t.Object.PkAuto && !keepPk {
+		return
+	}
+	pk := t.Object.PkValue(v)
+	pkValue, e := t.Pk.Get(pk)
+	if e != nil || pkValue == nil || !pkValue.Expired(now.UnixNano()) {
+		return
+	}
+	var saved interface{}
+	if t.watching() {
+		if saved, e = t.value(pkValue); e != nil {
+			return
+		}
+	}
+	if e = t.delete(pk, pkValue); e != nil {
+		return
+	}
+	if saved != nil {
+		t.notify(ChangeDelete, saved, nil)
+	}
+	return
+}
+
+// get expiration time in unix nanoseconds of value.
+// it uses expire field, or default ttl if expire field is empty.
+// 0 means never expired.
+func (t *Table) expireOf(v interface{}, now time.Time) int64 {
+	if t.Object.Expire != "" {
+		field := reflect.ValueOf(v).Elem().FieldByName(t.Object.Expire)
+		if !field.IsZero() {
+			if field.Type() == timeType {
+				return field.Interface().(time.Time).UnixNano()
+			}
+			return field.Int() * int64(time.Second)
+		}
+	}
+	if t.ttl > 0 {
+		return now.Add(t.ttl).UnixNano()
+	}
+	return 0
+}
+
+// get pkValue by pk.
+// expired pkValue is nil.
+func (t *Table) getPk(pk interface{}) (pkValue *col.PkValue, e error) {
+	pkValue, e = t.Pk.Get(pk)
+	if pkValue != nil && pkValue.Expired(time.Now().UnixNano()) {
+		pkValue = nil
+	}
+	return
+}
+
+// update value to chunk and pk by pkValue.
+// it checks pk is not modified, checks and increases version.
+func (t *Table) update(pk interface{}, pkValue *col.PkValue, v interface{}) (e error) {
+	if e = beforeUpdate(v); e != nil {
+		return
+	}
+	if key, _ := col.EncodeKey(t.Object.PkValue(v)); string(key) != string(pkValue.Key) {
+		e = fmt.Errorf("pk can't be modified : %s", t.Object.DataType.String())
+		return
+	}
+	if e = t.checkVersion(pkValue, v); e != nil {
+		return
+	}
+	saved, e := t.value(pkValue)
+	if e != nil {
+		return
+	}
+	now := time.Now()
+	version := t.getVersion(v)
+	t.setVersion(v, version+1)
+	t.setTimes(v, saved, now)
+	if e = t.replace(pk, pkValue, v, saved, now); e != nil {
+		t.setVersion(v, version)
+	}
+	return
+}
+
+// replace saved value by v in chunk and pk.
+// v is written as it is, version and time fields are set by caller.
+func (t *Table) replace(pk interface{}, pkValue *col.PkValue, v interface{}, saved interface{}, now time.Time) (e error) {
+	// write to data chunk
+	if e = t.Chunk.Update(t.copyValue(v), pkValue); e != nil {
+		return
+	}
+	pkValue.Exp = t.expireOf(v, now)
+
+	// write to pk
+	if e = t.Pk.Update(pk, pkValue); e != nil {
+		return
+	}
+	afterUpdate(v)
+	t.notify(ChangeUpdate, saved, v)
 	return
 }
 
+// prepare value to insert.
+// set version as 1, and set created and updated times.
+func (t *Table) prepareInsert(v interface{}, now time.Time) {
+	t.setVersion(v, 1)
+	t.setTimes(v, nil, now)
+}
+
+// prepare imported value to insert or overwrite.
+// imported version and time fields are kept, only empty ones are set as inserting.
+func (t *Table) prepareImport(v interface{}, now time.Time) {
+	if t.getVersion(v) == 0 {
+		t.setVersion(v, 1)
+	}
+	rv := reflect.ValueOf(v).Elem()
+	for _, name := range []string{t.Object.Created, t.Object.Updated} {
+		if name != "" && rv.FieldByName(name).IsZero() {
+			setTimeField(rv.FieldByName(name), now)
+		}
+	}
+}
+
+// set created and updated time fields.
+// created time is kept from saved value if updating,
+// or set if empty when inserting.
+func (t *Table) setTimes(v interface{}, saved interface{}, now time.Time) {
+	rv := reflect.ValueOf(v).Elem()
+	if t.Object.Created != "" {
+		field := rv.FieldByName(t.Object.Created)
+		if saved != nil {
+			field.Set(reflect.ValueOf(saved).Elem().FieldByName(t.Object.Created))
+		} else if field.IsZero() {
+			setTimeField(field, now)
+		}
+	}
+	if t.Object.Updated != "" {
+		setTimeField(rv.FieldByName(t.Object.Updated), now)
+	}
+}
+
+// check version of value is same as saved value.
+func (t *Table) checkVersion(pkValue *col.PkValue, v interface{}) (e error) {
+	if t.Object.Version == "" {
+		return
+	}
+	saved, e := t.value(pkValue)
+	if e != nil || saved == nil {
+		return
+	}
+	if t.getVersion(saved) != t.getVersion(v) {
+		e = ErrStaleVersion
+	}
+	return
+}
+
+// check version of value to delete.
+// zero version means deleting without checking.
+func (t *Table) checkDeleteVersion(pkValue *col.PkValue, v interface{}) (e error) {
+	if t.Object.Version == "" || t.getVersion(v) == 0 {
+		return
+	}
+	return t.checkVersion(pkValue, v)
+}
+
+// get version field value.
+func (t *Table) getVersion(v interface{}) int64 {
+	if t.Object.Version == "" {
+		return 0
+	}
+	return reflect.ValueOf(v).Elem().FieldByName(t.Object.Version).Int()
+}
+
+// set version field value.
+func (t *Table) setVersion(v interface{}, version int64) {
+	if t.Object.Version == "" {
+		return
+	}
+	reflect.ValueOf(v).Elem().FieldByName(t.Object.Version).SetInt(version)
+}
+
+// delete pk and data in chunk by pkValue.
+func (t *Table) delete(pk interface{}, pkValue *col.PkValue) (e error) {
+	// delete in pk first.
+	if e = t.Pk.Delete(pk); e != nil {
+		return
+	}
+	e = t.Chunk.Delete(pkValue)
+	return
+}
+
+// get memory value by pkValue.
+// error of broken chunk file is corrupt error.
+func (t *Table) value(pkValue *col.PkValue) (v interface{}, e error) {
+	if v, e = t.Chunk.Get(pkValue); e != nil {
+		e = t.corrupt(keyPk(pkValue.Key), t.Chunk.GetFile(pkValue.Cursor), e)
+	}
+	return
+}
+
+// load pkValue and memory value by pk.
+// value is nil if not found.
+func (t *Table) load(pk interface{}) (pkValue *col.PkValue, value interface{}, e error) {
+	pkValue, e = t.getPk(pk)
+	if e != nil || pkValue == nil {
+		return
+	}
+	value, e = t.value(pkValue)
+	return
+}
+
+// copy value to new struct pointer,
+// so memory value never shares pointer with caller.
+func (t *Table) copyValue(v interface{}) interface{} {
+	rv := reflect.New(t.Object.DataType)
+	rv.Elem().Set(reflect.ValueOf(v).Elem())
+	return rv.Interface()
+}
+
 // init table.
 // if first run, create chunk and pk.
 // otherwise, read chunk data and pk data.
-func (t *Table) init() (e error) {
+func (t *Table) init(ctx context.Context) (e error) {
 	if !com.IsDir(t.directory) {
 		e = t.firstInit()
 		return
 	}
 
 	// read pk file
+	start := time.Now()
 	dir := path.Join(t.directory, "_pk")
-	if t.Pk, e = col.NewPk(dir, t.Object.PkAuto); e != nil {
+	if t.Pk, e = col.NewPk(dir, t.Object.PkAuto, t.Object.PkTypes); e != nil {
+		e = t.corrupt(nil, dir, e)
+		return
+	}
+	if t.options.Logger != nil {
+		t.logf("%s read pk, %d keys in %v", t.Object.DataType.String(), len(t.Pk.Prefix(nil)), time.Since(start))
+	}
+	if e = ctx.Err(); e != nil {
+		t.Pk.Close()
 		return
 	}
 
@@ -140,9 +1035,15 @@ func (t *Table) init() (e error) {
 	if t.Chunk, e = col.NewChunk(dir, "data", ".dat", 1000, t.Object.DataType); e != nil {
 		return
 	}
+	if t.options.Tolerant {
+		t.Chunk.SetTolerant(t.options.OnQuarantine)
+	}
+	t.setChunkHooks()
 
 	// read last chunk as default
-	e = t.Chunk.ReadCursorFile(t.Pk.GetLastCursor(), true)
+	if e = t.Chunk.ReadCurrent(t.Pk.GetLastCursor()); e != nil {
+		e = t.corrupt(nil, dir, e)
+	}
 
 	return
 }
@@ -161,10 +1062,14 @@ func (t *Table) firstInit() (e error) {
 	if t.Chunk, e = col.NewChunk(dir, "data", ".dat", 1000, t.Object.DataType); e != nil {
 		return
 	}
+	if t.options.Tolerant {
+		t.Chunk.SetTolerant(t.options.OnQuarantine)
+	}
+	t.setChunkHooks()
 
 	// init pk
 	dir = path.Join(t.directory, "_pk")
-	if t.Pk, e = col.NewPk(dir, t.Object.PkAuto); e != nil {
+	if t.Pk, e = col.NewPk(dir, t.Object.PkAuto, t.Object.PkTypes); e != nil {
 		return
 	}
 
@@ -174,19 +1079,137 @@ func (t *Table) firstInit() (e error) {
 // optimize table data.
 // chunk and pk are all optimized.
 func (t *Table) Optimize() (e error) {
-	if e = t.Pk.Optimize(); e != nil {
+	return t.OptimizeContext(context.Background())
+}
+
+// optimize table data until ctx is canceled.
+// optimized files are written by temp files and renamed,
+// so canceling leaves no half written optimized file, and table data are consistent.
+func (t *Table) OptimizeContext(ctx context.Context) (e error) {
+	defer t.observe("optimize", time.Now(), &e)
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	if e = t.checkClosed(); e != nil {
+		return
+	}
+	if e = ctx.Err(); e != nil {
 		return
 	}
-	e = t.Chunk.Optimize()
+
+	if e = t.deleteExpired(); e != nil {
+		return
+	}
+	t.Chunk.Retain(t.Pk.Prefix(nil))
+	if e = t.Pk.OptimizeContext(ctx); e != nil {
+		return
+	}
+	e = t.Chunk.OptimizeContext(ctx)
 	return
 }
 
+// get broken frames quarantined in tolerant loading.
+func (t *Table) Quarantined() []*col.Quarantine {
+	t.lock.RLock()
+	defer t.lock.RUnlock()
+	return t.Chunk.Quarantined()
+}
+
+// delete all expired values,
+// so they are cleaned physically in optimizing.
+func (t *Table) deleteExpired() (e error) {
+	now := time.Now().UnixNano()
+	var keys [][]byte
+	var pkValues []*col.PkValue
+	for _, pkValue := range t.Pk.Prefix(nil) {
+		if pkValue.Expired(now) {
+			keys = append(keys, pkValue.Key)
+			pkValues = append(pkValues, pkValue)
+		}
+	}
+	if len(keys) < 1 {
+		return
+	}
+	var saves []interface{}
+	if t.watching() {
+		saves = make([]interface{}, len(pkValues))
+		for i, pkValue := range pkValues {
+			if saves[i], e = t.value(pkValue); e != nil {
+				return
+			}
+		}
+	}
+	if e = t.Pk.DeleteKeys(keys); e != nil {
+		return
+	}
+	if e = t.Chunk.DeleteMany(pkValues); e != nil {
+		return
+	}
+	for _, saved := range saves {
+		if saved != nil {
+			t.notify(ChangeDelete, saved, nil)
+		}
+	}
+	return
+}
+
+// close table files and watchers.
+// it saves auto increment id, so next opening continues from it.
+func (t *Table) Close() (e error) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	if t.closed {
+		return
+	}
+
+	for w := range t.watchers {
+		t.closeWatcher(w)
+	}
+
+	if e = t.Chunk.Close(); e != nil {
+		return
+	}
+	if e = t.Pk.Close(); e != nil {
+		return
+	}
+	t.closed = true
+	return
+}
+
+// error if table is closed, under lock.
+func (t *Table) checkClosed() error {
+	if t.closed {
+		return t.error(ErrClosed, nil, nil)
+	}
+	return nil
+}
+
 // create new table in directory with object definition.
-func NewTable(directory string, obj *Object) (t *Table, e error) {
+// schema file is written, so tools can read table without Go types.
+// options are optional.
+func NewTable(directory string, obj *Object, opts ...Options) (t *Table, e error) {
+	return NewTableContext(context.Background(), directory, obj, opts...)
+}
+
+// create table and read its files until ctx is canceled.
+// ctx is checked between reading pk and chunk files, opened files are closed when canceled.
+func NewTableContext(ctx context.Context, directory string, obj *Object, opts ...Options) (t *Table, e error) {
 	t = &Table{
 		directory: directory,
 		Object:    obj,
 	}
-	e = t.init()
+	if len(opts) > 0 {
+		t.options = opts[0]
+	}
+	if e = ctx.Err(); e != nil {
+		return
+	}
+	if e = t.init(ctx); e != nil {
+		return
+	}
+	if e = ctx.Err(); e != nil {
+		t.Close()
+		return
+	}
+	e = writeSchema(t.directory, obj.Schema())
 	return
 }
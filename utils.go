@@ -1,10 +1,52 @@
 package jx
 
-import "reflect"
+import (
+	"context"
+	"io"
+	"math"
+	"reflect"
+	"time"
+)
 
-// is string,int64 or float64 type.
-func isBaseType(k reflect.Kind) bool {
-	return k == reflect.String || k == reflect.Int64 || k == reflect.Float64
+var timeType = reflect.TypeOf(time.Time{})
+
+// is valid pk type.
+// string, int, int32, int64, uint32, uint64, float64, time.Time or byte array.
+func isPkType(rt reflect.Type) bool {
+	if rt == timeType {
+		return true
+	}
+	switch rt.Kind() {
+	case reflect.String, reflect.Float64:
+		return true
+	case reflect.Array:
+		return rt.Elem().Kind() == reflect.Uint8
+	}
+	return isAutoPkType(rt)
+}
+
+// is valid auto-increment pk type.
+// int, int32, int64, uint32 or uint64.
+func isAutoPkType(rt reflect.Type) bool {
+	switch rt.Kind() {
+	case reflect.Int, reflect.Int32, reflect.Int64, reflect.Uint32, reflect.Uint64:
+		return true
+	}
+	return false
+}
+
+// is time.Time or int64 unix seconds type for time field.
+func isTimeType(rt reflect.Type) bool {
+	return rt == timeType || rt.Kind() == reflect.Int64
+}
+
+// set time to time.Time or int64 unix seconds field.
+func setTimeField(field reflect.Value, t time.Time) {
+	if field.Type() == timeType {
+		field.Set(reflect.ValueOf(t))
+		return
+	}
+	field.SetInt(t.Unix())
 }
 
 // get reflect type of struct value.
@@ -16,3 +58,99 @@ func getReflectType(v interface{}) reflect.Type {
 	}
 	return rt
 }
+
+// convert value to type without losing data.
+// assignable value is kept, number is converted to number type only if it's exact and not overflow.
+// other values, such as int to string or slice to array, are not converted.
+func convertValue(rv reflect.Value, rt reflect.Type) (reflect.Value, bool) {
+	if !rv.IsValid() {
+		return rv, false
+	}
+	if rv.Type().AssignableTo(rt) {
+		return rv, true
+	}
+	out := reflect.New(rt).Elem()
+	switch {
+	case isIntKind(rv.Kind()):
+		i := rv.Int()
+		switch {
+		case isIntKind(rt.Kind()) && !out.OverflowInt(i):
+			out.SetInt(i)
+		case isUintKind(rt.Kind()) && i >= 0 && !out.OverflowUint(uint64(i)):
+			out.SetUint(uint64(i))
+		case isFloatKind(rt.Kind()) && int64(float64(i)) == i && !out.OverflowFloat(float64(i)):
+			if out.SetFloat(float64(i)); out.Float() != float64(i) {
+				return rv, false
+			}
+		default:
+			return rv, false
+		}
+	case isUintKind(rv.Kind()):
+		u := rv.Uint()
+		switch {
+		case isIntKind(rt.Kind()) && u <= math.MaxInt64 && !out.OverflowInt(int64(u)):
+			out.SetInt(int64(u))
+		case isUintKind(rt.Kind()) && !out.OverflowUint(u):
+			out.SetUint(u)
+		case isFloatKind(rt.Kind()) && float64(u) < 1<<64 && uint64(float64(u)) == u && !out.OverflowFloat(float64(u)):
+			if out.SetFloat(float64(u)); out.Float() != float64(u) {
+				return rv, false
+			}
+		default:
+			return rv, false
+		}
+	case isFloatKind(rv.Kind()):
+		f := rv.Float()
+		switch {
+		case isIntKind(rt.Kind()) && f == math.Trunc(f) && f >= math.MinInt64 && f < math.MaxInt64 && !out.OverflowInt(int64(f)):
+			out.SetInt(int64(f))
+		case isUintKind(rt.Kind()) && f == math.Trunc(f) && f >= 0 && f < math.MaxUint64 && !out.OverflowUint(uint64(f)):
+			out.SetUint(uint64(f))
+		case isFloatKind(rt.Kind()) && !out.OverflowFloat(f):
+			if out.SetFloat(f); out.Float() != f && !math.IsNaN(f) {
+				return rv, false
+			}
+		default:
+			return rv, false
+		}
+	default:
+		return rv, false
+	}
+	return out, true
+}
+
+// is signed integer kind.
+func isIntKind(k reflect.Kind) bool {
+	switch k {
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return true
+	}
+	return false
+}
+
+// is unsigned integer kind.
+func isUintKind(k reflect.Kind) bool {
+	switch k {
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+		return true
+	}
+	return false
+}
+
+// is float kind.
+func isFloatKind(k reflect.Kind) bool {
+	return k == reflect.Float32 || k == reflect.Float64
+}
+
+// reader stops reading when ctx is canceled.
+type contextReader struct {
+	ctx context.Context
+	r   io.Reader
+}
+
+func (r *contextReader) Read(p []byte) (n int, e error) {
+	if e = r.ctx.Err(); e != nil {
+		return
+	}
+	return r.r.Read(p)
+}
@@ -0,0 +1,284 @@
+package jx
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"github.com/fuxiaohei/jx/col"
+	"reflect"
+	"sort"
+)
+
+// problem kinds in verify report.
+const (
+	ProblemMissingValue   = "missing value"
+	ProblemPkMismatch     = "pk mismatch"
+	ProblemAutoIncrement  = "auto increment"
+	ProblemCorruptFrame   = "corrupt frame"
+	ProblemTruncatedFrame = "truncated frame"
+)
+
+// VerifyReport is result of verifying tables.
+type VerifyReport struct {
+	Tables []*TableReport `json:"tables"`
+}
+
+// no problem in all tables.
+func (r *VerifyReport) OK() bool {
+	for _, t := range r.Tables {
+		if !t.OK() {
+			return false
+		}
+	}
+	return true
+}
+
+// TableReport is result of verifying one table.
+// orphan frames are not pointed by any pk, such as old values of updated or deleted values.
+// they are not problems, and cleaned by optimizing.
+type TableReport struct {
+	Table    string      `json:"table"`
+	Values   int         `json:"values"`
+	Frames   int         `json:"frames"`
+	PkFrames int         `json:"pk_frames"`
+	Orphans  []*FrameRef `json:"orphans,omitempty"`
+	Problems []*Problem  `json:"problems,omitempty"`
+}
+
+// no problem in table.
+func (r *TableReport) OK() bool {
+	return len(r.Problems) == 0
+}
+
+// FrameRef is position of frame in chunk file.
+type FrameRef struct {
+	File   string `json:"file"`
+	Offset int64  `json:"offset"`
+	Uid    int64  `json:"uid"`
+}
+
+// Problem is found by verifying.
+// pk is single value or []interface{} of composite pk, if problem is about a pk.
+type Problem struct {
+	Kind    string      `json:"kind"`
+	Pk      interface{} `json:"pk,omitempty"`
+	File    string      `json:"file,omitempty"`
+	Offset  int64       `json:"offset,omitempty"`
+	Message string      `json:"message"`
+}
+
+// verify all synced tables.
+func (s *Storage) Verify() (report *VerifyReport, e error) {
+	return s.VerifyContext(context.Background())
+}
+
+// verify all synced tables until ctx is canceled.
+func (s *Storage) VerifyContext(ctx context.Context) (report *VerifyReport, e error) {
+	tables := s.Tables()
+	names := make([]string, 0, len(tables))
+	for name := range tables {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	report = new(VerifyReport)
+	for _, name := range names {
+		r, e := tables[name].VerifyContext(ctx)
+		if e != nil {
+			return nil, e
+		}
+		report.Tables = append(report.Tables, r)
+	}
+	return
+}
+
+// verify table files, under table read lock.
+// it walks all chunk files and pk file, checks each pk points to value with same pk,
+// auto increment id is not less than max pk, and finds broken frames.
+func (t *Table) Verify() (r *TableReport, e error) {
+	return t.VerifyContext(context.Background())
+}
+
+// verify table files until ctx is canceled.
+func (t *Table) VerifyContext(ctx context.Context) (r *TableReport, e error) {
+	t.lock.RLock()
+	defer t.lock.RUnlock()
+	if e = t.checkClosed(); e != nil {
+		return
+	}
+
+	return VerifyTableContext(ctx, t.Object.DataType.String(), t.Pk, t.Chunk, t.Object.PkAuto, func(data []byte) ([]byte, error) {
+		v := reflect.New(t.Object.DataType).Interface()
+		if e := json.Unmarshal(data, v); e != nil {
+			return nil, e
+		}
+		return col.EncodeKey(t.Object.PkValue(v))
+	})
+}
+
+// frame info for verifying.
+type verifyFrame struct {
+	ref  *FrameRef
+	key  []byte
+	bad  bool
+	used bool
+}
+
+// verify table by pk and chunk.
+// keyOf gets pk key bytes of value data, or error if data is corrupt.
+// nil key means not checking pk of value.
+// it's used by tools without Go types.
+func VerifyTable(name string, pk *col.PK, chunk *col.Chunk, auto bool, keyOf func(data []byte) ([]byte, error)) (r *TableReport, e error) {
+	return VerifyTableContext(context.Background(), name, pk, chunk, auto, keyOf)
+}
+
+// verify table by pk and chunk until ctx is canceled.
+// it returns ctx error and no report if canceled.
+func VerifyTableContext(ctx context.Context, name string, pk *col.PK, chunk *col.Chunk, auto bool, keyOf func(data []byte) ([]byte, error)) (r *TableReport, e error) {
+	r = &TableReport{Table: name}
+
+	// walk chunk frames
+	frames := make(map[int]map[int64]*verifyFrame)
+	var order []*verifyFrame
+	broken, e := chunk.WalkFrames(func(f *col.Frame) error {
+		if e := ctx.Err(); e != nil {
+			return e
+		}
+		if f.Deleted {
+			// deleted value becomes orphan
+			delete(frames[f.Cursor], f.Uid)
+			return nil
+		}
+		r.Frames++
+		vf := &verifyFrame{ref: &FrameRef{File: f.File, Offset: f.Offset, Uid: f.Uid}}
+		key, e := keyOf(f.Data)
+		if e != nil {
+			vf.bad = true
+			r.Problems = append(r.Problems, &Problem{Kind: ProblemCorruptFrame, File: f.File, Offset: f.Offset, Message: e.Error()})
+		}
+		vf.key = key
+		if frames[f.Cursor] == nil {
+			frames[f.Cursor] = make(map[int64]*verifyFrame)
+		}
+		frames[f.Cursor][f.Uid] = vf
+		order = append(order, vf)
+		return nil
+	})
+	if e != nil {
+		return nil, e
+	}
+	for _, b := range broken {
+		r.Problems = append(r.Problems, frameProblem(b))
+	}
+
+	// walk pk log
+	var maxId int64
+	pkBroken, e := pk.WalkFrames(func(f *col.Frame) error {
+		if e := ctx.Err(); e != nil {
+			return e
+		}
+		r.PkFrames++
+		v := new(col.PkValue)
+		if e := json.Unmarshal(f.Data, v); e != nil {
+			r.Problems = append(r.Problems, &Problem{Kind: ProblemCorruptFrame, File: f.File, Offset: f.Offset, Message: e.Error()})
+			return nil
+		}
+		if id := autoKey(v.Key); id > maxId {
+			maxId = id
+		}
+		return nil
+	})
+	if e != nil {
+		return nil, e
+	}
+	if pkBroken != nil {
+		r.Problems = append(r.Problems, frameProblem(pkBroken))
+	}
+
+	// check pk values point to values
+	pkValues := pk.Prefix(nil)
+	r.Values = len(pkValues)
+	for _, pkValue := range pkValues {
+		vf := frames[pkValue.Cursor][pkValue.Uid]
+		if vf == nil {
+			r.Problems = append(r.Problems, &Problem{
+				Kind:    ProblemMissingValue,
+				Pk:      keyPk(pkValue.Key),
+				File:    chunk.GetFile(pkValue.Cursor),
+				Message: fmt.Sprintf("no value of uid %d", pkValue.Uid),
+			})
+			continue
+		}
+		vf.used = true
+		if !vf.bad && vf.key != nil && string(vf.key) != string(pkValue.Key) {
+			r.Problems = append(r.Problems, &Problem{
+				Kind:    ProblemPkMismatch,
+				Pk:      keyPk(pkValue.Key),
+				File:    vf.ref.File,
+				Offset:  vf.ref.Offset,
+				Message: fmt.Sprintf("value pk is %v", keyPk(vf.key)),
+			})
+		}
+	}
+	for _, vf := range order {
+		if !vf.used {
+			r.Orphans = append(r.Orphans, vf.ref)
+		}
+	}
+
+	// check auto increment id
+	if auto {
+		if pk.GetAutoIncrement() < maxId {
+			r.Problems = append(r.Problems, &Problem{
+				Kind:    ProblemAutoIncrement,
+				Message: fmt.Sprintf("auto increment id %d is less than max pk %d", pk.GetAutoIncrement(), maxId),
+			})
+		}
+		saved, e := pk.SavedAutoIncrement()
+		if e != nil {
+			r.Problems = append(r.Problems, &Problem{Kind: ProblemAutoIncrement, Message: e.Error()})
+		} else if saved < maxId {
+			r.Problems = append(r.Problems, &Problem{
+				Kind:    ProblemAutoIncrement,
+				Message: fmt.Sprintf("saved auto increment id %d is less than max pk %d", saved, maxId),
+			})
+		}
+	}
+	return r, nil
+}
+
+// problem of broken frame.
+func frameProblem(b *col.FrameError) *Problem {
+	p := &Problem{Kind: ProblemCorruptFrame, File: b.File, Offset: b.Offset, Message: b.Reason}
+	if b.Truncated {
+		p.Kind = ProblemTruncatedFrame
+	}
+	return p
+}
+
+// decode key to pk value for report.
+func keyPk(key []byte) interface{} {
+	fields, e := col.DecodeKey(key)
+	if e != nil {
+		return fmt.Sprintf("%x", key)
+	}
+	if len(fields) == 1 {
+		return fields[0]
+	}
+	return fields
+}
+
+// get auto increment id of key, 0 if not int key.
+func autoKey(key []byte) int64 {
+	fields, e := col.DecodeKey(key)
+	if e != nil || len(fields) != 1 {
+		return 0
+	}
+	switch id := fields[0].(type) {
+	case int64:
+		return id
+	case uint64:
+		return int64(id)
+	}
+	return 0
+}
@@ -0,0 +1,148 @@
+package jx
+
+import (
+	"errors"
+	"sync"
+)
+
+// ErrWatcherOverflow means watcher buffer is full,
+// the watcher is closed and changes after it are lost.
+var ErrWatcherOverflow = errors.New("watcher overflow")
+
+// change type of value.
+type ChangeType int
+
+const (
+	ChangeInsert ChangeType = iota + 1
+	ChangeUpdate
+	ChangeDelete
+)
+
+// change type name.
+func (c ChangeType) String() string {
+	switch c {
+	case ChangeInsert:
+		return "insert"
+	case ChangeUpdate:
+		return "update"
+	case ChangeDelete:
+		return "delete"
+	}
+	return "unknown"
+}
+
+// Change is a value change sent to watchers.
+// Old is nil when inserting, New is nil when deleting.
+// values are copies, shared by all watchers of the table.
+type Change struct {
+	Type ChangeType
+	Pk   interface{}
+	Old  interface{}
+	New  interface{}
+}
+
+// WatchOptions sets watcher buffer.
+type WatchOptions struct {
+	// channel buffer size, default is 100.
+	// if buffer is full, the watcher is closed with ErrWatcherOverflow.
+	Buffer int
+}
+
+// Watcher receives changes of table values in writing order.
+type Watcher struct {
+	// changes channel, it's closed after unsubscribing, overflow or closing storage.
+	C <-chan *Change
+
+	ch    chan *Change
+	table *Table
+
+	// closed is guarded by table lock.
+	closed bool
+
+	lock sync.Mutex
+	err  error
+}
+
+// stop receiving changes and close the channel.
+// buffered changes in channel can be still received.
+func (w *Watcher) Unsubscribe() {
+	w.table.lock.Lock()
+	defer w.table.lock.Unlock()
+	w.table.closeWatcher(w)
+}
+
+// get error that closes watcher, nil if unsubscribed or still watching.
+func (w *Watcher) Err() error {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+	return w.err
+}
+
+// send change to watcher, under table lock.
+// it never waits for receiving, so watcher can operate storage when receiving.
+func (w *Watcher) send(c *Change) {
+	select {
+	case w.ch <- c:
+	default:
+		w.lock.Lock()
+		w.err = ErrWatcherOverflow
+		w.lock.Unlock()
+		w.table.closeWatcher(w)
+	}
+}
+
+// watch changes of values in table.
+func (t *Table) Watch(opts WatchOptions) *Watcher {
+	if opts.Buffer < 1 {
+		opts.Buffer = 100
+	}
+	ch := make(chan *Change, opts.Buffer)
+	w := &Watcher{
+		C:     ch,
+		ch:    ch,
+		table: t,
+	}
+
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	if t.watchers == nil {
+		t.watchers = make(map[*Watcher]bool)
+	}
+	t.watchers[w] = true
+	return w
+}
+
+// whether table has watchers, so changes need to be built.
+func (t *Table) watching() bool {
+	return len(t.watchers) > 0
+}
+
+// send change to all watchers.
+// old and new values are copied, so they are not shared with memory or caller.
+func (t *Table) notify(typ ChangeType, oldValue interface{}, newValue interface{}) {
+	if !t.watching() {
+		return
+	}
+	c := &Change{Type: typ}
+	if oldValue != nil {
+		c.Old = t.copyValue(oldValue)
+		c.Pk = t.Object.PkValue(oldValue)
+	}
+	if newValue != nil {
+		c.New = t.copyValue(newValue)
+		c.Pk = t.Object.PkValue(newValue)
+	}
+	for w := range t.watchers {
+		w.send(c)
+	}
+}
+
+// remove watcher and close its channel, under table lock.
+func (t *Table) closeWatcher(w *Watcher) {
+	if w.closed {
+		return
+	}
+	w.closed = true
+	delete(t.watchers, w)
+	close(w.ch)
+}